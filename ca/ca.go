@@ -0,0 +1,264 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"github.com/praetorian-inc/trudy/pipe"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+//Authority is a local certificate authority that mints a certificate for
+//every host a client connects to. Install the authority's certificate on the
+//device under test and it will trust Trudy for every host, instead of only for
+//the names in a single static certificate.
+type Authority struct {
+	Certificate *x509.Certificate
+	PrivateKey  crypto.Signer
+	//Clone makes every certificate a clone of the certificate presented by
+	//the client's original destination, down to its issuer name, serial
+	//number and validity, for clients that check those fields instead of
+	//validating the chain.
+	Clone bool
+
+	//leafKey is shared by every minted certificate. Generating a key per
+	//host would make the first connection to every host noticeably slow.
+	leafKey crypto.Signer
+	cache   map[string]*tls.Certificate
+	mutex   *sync.Mutex
+}
+
+//Load reads the CA certificate and key from certPath and keyPath. If neither
+//file exists, a new CA is generated and written to them so the same CA is
+//used the next time Trudy runs.
+func Load(certPath, keyPath string) (ca *Authority, err error) {
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+	if errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist) {
+		if err = generate(certPath, keyPath); err != nil {
+			return
+		}
+		log.Printf("[INFO] Generated a new CA certificate at %v\n", certPath)
+	}
+
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return
+	}
+	if !cert.IsCA {
+		return nil, errors.New(certPath + " is not a CA certificate")
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported CA private key type")
+	}
+	leafKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return
+	}
+	return &Authority{Certificate: cert,
+		PrivateKey: key,
+		leafKey:    leafKey,
+		cache:      make(map[string]*tls.Certificate),
+		mutex:      new(sync.Mutex)}, nil
+}
+
+//generate creates a self-signed CA certificate and key and writes them to
+//certPath and keyPath as PEM.
+func generate(certPath, keyPath string) (err error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return
+	}
+	template := &x509.Certificate{SerialNumber: serial,
+		Subject:               pkix.Name{CommonName: "Trudy CA", Organization: []string{"Trudy"}},
+		NotBefore:             time.Now().Add(-24 * time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err = os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return
+	}
+	return os.WriteFile(keyPath, keyPEM, 0600)
+}
+
+//PEM returns the CA certificate in PEM form, ready to be installed on a
+//device.
+func (ca *Authority) PEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate.Raw})
+}
+
+//GetCertificate implements tls.Config.GetCertificate. The certificate is
+//minted for the server name the client sent with SNI. If the client did not
+//send one, the certificate copies the subject and names of the certificate
+//presented by the client's original destination. If Clone is set, the
+//certificate is a clone of the destination's certificate instead.
+func (ca *Authority) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.ServerName != "" && !ca.Clone {
+		return ca.mint(hello.ServerName, func() (*x509.Certificate, *x509.Certificate) {
+			return leafTemplate(hello.ServerName), nil
+		})
+	}
+
+	dest, err := pipe.OriginalDestination(hello.Conn)
+	if err != nil {
+		return nil, err
+	}
+	if ca.Clone {
+		return ca.mint(dest+"/"+hello.ServerName, func() (*x509.Certificate, *x509.Certificate) {
+			original, err := serverCertificate(dest, hello.ServerName)
+			if err != nil {
+				log.Printf("[ERR] Could not clone the certificate of %v: %v\n", dest, err)
+				name := hello.ServerName
+				if name == "" {
+					name = dest
+				}
+				return leafTemplate(name), nil
+			}
+			return cloneTemplate(original)
+		})
+	}
+	return ca.mint(dest, func() (*x509.Certificate, *x509.Certificate) {
+		template := leafTemplate(dest)
+		original, err := serverCertificate(dest, "")
+		if err != nil {
+			log.Printf("[ERR] Could not get the certificate of %v: %v\n", dest, err)
+			return template, nil
+		}
+		template.Subject = original.Subject
+		template.RawSubject = original.RawSubject
+		template.DNSNames = original.DNSNames
+		template.IPAddresses = original.IPAddresses
+		return template, nil
+	})
+}
+
+//mint returns the certificate cached under key, signing the certificate
+//returned by template and caching it first if there is none. template also
+//returns the certificate to use as the issuer, or nil for the CA certificate.
+func (ca *Authority) mint(key string, template func() (leaf, parent *x509.Certificate)) (*tls.Certificate, error) {
+	ca.mutex.Lock()
+	cert, ok := ca.cache[key]
+	ca.mutex.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	leaf, parent := template()
+	if leaf.SerialNumber == nil {
+		serial, err := serialNumber()
+		if err != nil {
+			return nil, err
+		}
+		leaf.SerialNumber = serial
+	}
+	chain := [][]byte{nil}
+	if parent == nil {
+		parent = ca.Certificate
+		chain = append(chain, ca.Certificate.Raw)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, leaf, parent, ca.leafKey.Public(), ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	chain[0] = der
+	cert = &tls.Certificate{Certificate: chain, PrivateKey: ca.leafKey}
+
+	ca.mutex.Lock()
+	ca.cache[key] = cert
+	ca.mutex.Unlock()
+	return cert, nil
+}
+
+//cloneTemplate returns a template that reproduces the subject, names, serial
+//number, validity and usages of original, along with a parent that makes the
+//clone carry original's issuer name. The parent has no public key, so the
+//clone can be signed with the CA key even though the issuer name is not the
+//CA's.
+func cloneTemplate(original *x509.Certificate) (leaf, parent *x509.Certificate) {
+	leaf = &x509.Certificate{SerialNumber: original.SerialNumber,
+		Subject:               original.Subject,
+		RawSubject:            original.RawSubject,
+		NotBefore:             original.NotBefore,
+		NotAfter:              original.NotAfter,
+		KeyUsage:              original.KeyUsage,
+		ExtKeyUsage:           original.ExtKeyUsage,
+		UnknownExtKeyUsage:    original.UnknownExtKeyUsage,
+		BasicConstraintsValid: original.BasicConstraintsValid,
+		IsCA:                  original.IsCA,
+		DNSNames:              original.DNSNames,
+		EmailAddresses:        original.EmailAddresses,
+		IPAddresses:           original.IPAddresses,
+		URIs:                  original.URIs,
+		SubjectKeyId:          original.SubjectKeyId}
+	parent = &x509.Certificate{Subject: original.Issuer,
+		RawSubject:   original.RawIssuer,
+		SubjectKeyId: original.AuthorityKeyId}
+	return
+}
+
+//leafTemplate returns a template for a server certificate valid for name,
+//which is either a host name or an IP address (with or without a port).
+func leafTemplate(name string) *x509.Certificate {
+	if host, _, err := net.SplitHostPort(name); err == nil {
+		name = host
+	}
+	template := &x509.Certificate{Subject: pkix.Name{CommonName: name},
+		NotBefore:   time.Now().Add(-24 * time.Hour),
+		NotAfter:    time.Now().AddDate(1, 0, 0),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{name}
+	}
+	return template
+}
+
+//serverCertificate connects to addr, sending serverName with SNI if it is not
+//empty, and returns the leaf certificate the server presents.
+func serverCertificate(addr, serverName string) (*x509.Certificate, error) {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	config := &tls.Config{ServerName: serverName, InsecureSkipVerify: true}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate presented")
+	}
+	return certs[0], nil
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
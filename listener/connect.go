@@ -0,0 +1,70 @@
+package listener
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+//ConnectListener implements the TrudyListener interface for clients that are
+//explicitly configured to use Trudy as an HTTP proxy (e.g. with https_proxy).
+//Clients open a tunnel with an HTTP CONNECT request, and the tunnel is handed
+//to Accept carrying the destination from the request. If Listen is given a
+//tls.Config, Trudy terminates TLS inside the tunnel like the TLSListener does.
+type ConnectListener struct {
+	explicitProxy
+	Config *tls.Config
+}
+
+func (cl *ConnectListener) Listen(nets string, laddr net.Addr, config *tls.Config) {
+	cl.Config = config
+	cl.listen(nets, laddr, "HTTP CONNECT", cl.handshake)
+}
+
+func (cl *ConnectListener) handshake(conn *net.TCPConn) (err error) {
+	r := bufio.NewReaderSize(conn, maxRecordSize)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return
+	}
+	if req.Method != http.MethodConnect {
+		conn.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\nConnection: close\r\n\r\n"))
+		return errors.New("unsupported method " + req.Method)
+	}
+	tunnel := &ProxyConn{Conn: conn, reader: r, dest: connectDestination(req),
+		reply: func(_ net.Addr, err error) error {
+			if err != nil {
+				_, err = conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\n\r\n"))
+				return err
+			}
+			_, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+			return err
+		}}
+	if cl.Config == nil {
+		//The client is answered once the pipe has dialed the
+		//destination.
+		cl.push(tunnel)
+		return nil
+	}
+	//The client only starts its TLS handshake once it has been answered,
+	//and the pipe finishes the handshake before it dials.
+	if err = tunnel.ReportDial(nil, nil); err != nil {
+		return
+	}
+	cl.push(tls.Server(tunnel, cl.Config))
+	return nil
+}
+
+//connectDestination returns the "host:port" a CONNECT request asks for. The
+//port defaults to 443.
+func connectDestination(req *http.Request) string {
+	if _, _, err := net.SplitHostPort(req.Host); err != nil {
+		//An IPv6 address without a port is still bracketed.
+		host := strings.TrimSuffix(strings.TrimPrefix(req.Host, "["), "]")
+		return net.JoinHostPort(host, "443")
+	}
+	return req.Host
+}
@@ -1,18 +1,21 @@
 package listener
 
 import (
+	"bufio"
 	"crypto/tls"
 	"errors"
 	"net"
+	"time"
 )
 
 //The TrudyListener interface is used to listen for incoming connections and accept them. This is almost
 //the same as the typical Listener interface, except a net.Conn must be returned for Accept. This enables
 //Trudy to grab the original destination IP address from the kernel.
 type TrudyListener interface {
-	//TODO: Listen should take two strings: "tcp" or "udp" and a port to listen on.
-	//This parameter could create a Listener for both tcp and udp.
-	Listen(string, *net.TCPAddr, *tls.Config)
+	//Listen starts listening on the supplied network ("tcp" or "udp") and
+	//address. The address must be a *net.TCPAddr for TCP-based listeners and
+	//a *net.UDPAddr for UDP-based listeners.
+	Listen(string, net.Addr, *tls.Config)
 
 	//Accept returns a generic net.Conn and the file descriptor of the socket.
 	Accept() (int, net.Conn, error)
@@ -22,68 +25,147 @@ type TrudyListener interface {
 }
 
 //The TCPListener struct implements the TrudyListener interface and handles TCP connections.
+//If Upstream is set, every connection is forwarded to it instead of to its
+//original destination. If Listen is given a tls.Config, TCPListener peeks at
+//the first bytes of every connection and terminates TLS for connections that
+//start with a TLS ClientHello.
 type TCPListener struct {
 	Listener *net.TCPListener
+	Upstream string
+	Config   *tls.Config
+	//DetectTimeout is how long to wait for a ClientHello before treating a
+	//connection as plaintext. Protocols where the server speaks first are
+	//delayed by this much. Defaults to DefaultDetectTimeout.
+	DetectTimeout time.Duration
+	accepted      chan acceptedConn
+	done          chan struct{}
+}
+
+//DefaultDetectTimeout is the default TCPListener.DetectTimeout.
+const DefaultDetectTimeout = 500 * time.Millisecond
+
+type acceptedConn struct {
+	fd   int
+	conn net.Conn
 }
 
-func (tl *TCPListener) Listen(nets string, tcpAddr *net.TCPAddr, _ *tls.Config) {
-	tcpListener, err := net.ListenTCP(nets, tcpAddr)
+func (tl *TCPListener) Listen(nets string, tcpAddr net.Addr, config *tls.Config) {
+	tcpListener, err := net.ListenTCP(nets, tcpAddr.(*net.TCPAddr))
 	if err != nil {
 		panic(err)
 	}
 	tl.Listener = tcpListener
+	if config != nil && (len(config.Certificates) > 0 || config.GetCertificate != nil) {
+		tl.Config = config
+		if tl.DetectTimeout == 0 {
+			tl.DetectTimeout = DefaultDetectTimeout
+		}
+		tl.accepted = make(chan acceptedConn, 64)
+		tl.done = make(chan struct{})
+		go tl.detect()
+	}
 }
 
 func (tl *TCPListener) Accept() (fd int, conn net.Conn, err error) {
-	cpointer, err := tl.Listener.AcceptTCP()
-	if err != nil {
-		return
+	if tl.Config != nil {
+		select {
+		case a := <-tl.accepted:
+			return a.fd, a.conn, nil
+		case <-tl.done:
+			return -1, nil, net.ErrClosed
+		}
 	}
-	file, err := cpointer.File()
+	fd, conn, err = acceptTCP(tl.Listener)
 	if err != nil {
 		return
 	}
-	fd = int(file.Fd())
-	conn, err = net.FileConn(file)
-	if err != nil {
-		return
+	if tl.Upstream != "" {
+		conn = &ForwardConn{Conn: conn, Upstream: tl.Upstream}
 	}
 	return
 }
 
+//detect accepts connections and sniffs each of them in its own goroutine, so
+//a client that is slow to speak does not hold up the others.
+func (tl *TCPListener) detect() {
+	defer close(tl.done)
+	for {
+		fd, conn, err := acceptTCP(tl.Listener)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go func() {
+			conn := tl.sniff(conn)
+			select {
+			case tl.accepted <- acceptedConn{fd, conn}:
+			case <-tl.done:
+				conn.Close()
+			}
+		}()
+	}
+}
+
+//sniff peeks at the first bytes the client sends. If they look like a TLS
+//ClientHello, sniff returns a TLS server connection. Otherwise the
+//connection is returned as plaintext, with the peeked bytes still unread.
+func (tl *TCPListener) sniff(conn net.Conn) net.Conn {
+	peeked := newPeekedConn(conn)
+	conn.SetReadDeadline(time.Now().Add(tl.DetectTimeout))
+	header, _ := peeked.reader.Peek(6)
+	conn.SetReadDeadline(time.Time{})
+
+	var sniffed net.Conn = peeked
+	if tl.Upstream != "" {
+		sniffed = &ForwardConn{Conn: peeked, Upstream: tl.Upstream}
+	}
+	if IsClientHello(header) {
+		return tls.Server(sniffed, tl.Config)
+	}
+	return sniffed
+}
+
+//IsClientHello reports whether header, the first bytes of a connection, is
+//the start of a TLS record containing a ClientHello.
+func IsClientHello(header []byte) bool {
+	//A handshake record (0x16) with a 3.x record version, followed by a
+	//two byte length and the ClientHello handshake type (0x01).
+	return len(header) >= 6 && header[0] == 0x16 && header[1] == 0x03 && header[5] == 0x01
+}
+
 func (tl *TCPListener) Close() error {
 	return tl.Listener.Close()
 }
 
 //TLSListener struct implements the TrudyListener interface and handles TCP connections over TLS.
+//If Upstream is set, every connection is forwarded to it instead of to its
+//original destination.
 type TLSListener struct {
 	Listener *net.TCPListener
 	Config   *tls.Config
+	Upstream string
 }
 
 func (tl *TLSListener) Accept() (fd int, conn net.Conn, err error) {
-	cpointer, err := tl.Listener.AcceptTCP()
+	fd, tcpConn, err := acceptTCP(tl.Listener)
 	if err != nil {
 		return
 	}
-	file, err := cpointer.File()
-	if err != nil {
-		return
-	}
-	fd = int(file.Fd())
-	fconn, err := net.FileConn(file)
-	if err != nil {
-		return
+	conn = newPeekedConn(tcpConn)
+	if tl.Upstream != "" {
+		conn = &ForwardConn{Conn: conn, Upstream: tl.Upstream}
 	}
-	conn = tls.Server(fconn, tl.Config)
+	conn = tls.Server(conn, tl.Config)
 	return
 }
 
-func (tl *TLSListener) Listen(nets string, laddr *net.TCPAddr, config *tls.Config) {
-	if len(config.Certificates) == 0 {
+func (tl *TLSListener) Listen(nets string, laddr net.Addr, config *tls.Config) {
+	if len(config.Certificates) == 0 && config.GetCertificate == nil {
 		panic(errors.New("tls.Listen: no certificates in configuration"))
 	}
-	tcpListener, err := net.ListenTCP(nets, laddr)
+	tcpListener, err := net.ListenTCP(nets, laddr.(*net.TCPAddr))
 	if err != nil {
 		panic(err)
 	}
@@ -94,3 +176,73 @@ func (tl *TLSListener) Listen(nets string, laddr *net.TCPAddr, config *tls.Confi
 func (tl *TLSListener) Close() error {
 	return tl.Listener.Close()
 }
+
+//ForwardConn is a connection accepted by a listener that forwards everything
+//to a fixed upstream. No help from netfilter is needed to proxy it.
+type ForwardConn struct {
+	net.Conn
+	Upstream string
+}
+
+//Destination returns the upstream "host:port" the connection is forwarded to.
+func (c *ForwardConn) Destination() string {
+	return c.Upstream
+}
+
+//PeekedConn is a connection whose first bytes may be looked at before they are
+//read, e.g. by the listener to find out what protocol the client speaks or
+//by the pipe to inspect a TLS ClientHello. Reads return the peeked bytes
+//first.
+type PeekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+//maxRecordSize is the size of the largest TLS record. Peeking connections
+//buffer this much so a whole ClientHello can be peeked at.
+const maxRecordSize = 5 + 1<<14
+
+func newPeekedConn(conn net.Conn) *PeekedConn {
+	return &PeekedConn{Conn: conn, reader: bufio.NewReaderSize(conn, maxRecordSize)}
+}
+
+func (c *PeekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+//Peek returns the next n bytes without reading them.
+func (c *PeekedConn) Peek(n int) ([]byte, error) {
+	return c.reader.Peek(n)
+}
+
+//acceptTCP accepts a connection and returns it along with the file
+//descriptor of its socket. The file descriptor belongs to the returned
+//connection and is only valid until the connection is closed.
+func acceptTCP(l *net.TCPListener) (fd int, conn *net.TCPConn, err error) {
+	conn, err = l.AcceptTCP()
+	if err != nil {
+		return
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	err = raw.Control(func(sysfd uintptr) {
+		fd = int(sysfd)
+	})
+	if err != nil {
+		conn.Close()
+	}
+	return
+}
+
+//NetConn returns the connection PeekedConn wraps.
+func (c *PeekedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+//NetConn returns the connection ForwardConn wraps.
+func (c *ForwardConn) NetConn() net.Conn {
+	return c.Conn
+}
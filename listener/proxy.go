@@ -0,0 +1,121 @@
+package listener
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+)
+
+//explicitProxy implements what the listeners for proxy-aware clients have in
+//common: each accepted connection needs a handshake before Trudy knows where
+//the client wants to go. Handshakes run in their own goroutines so a slow
+//client cannot hold up the others, and connections are handed to Accept as
+//their handshakes complete.
+type explicitProxy struct {
+	Listener *net.TCPListener
+	accept   chan net.Conn
+	done     chan struct{}
+}
+
+func (ep *explicitProxy) listen(nets string, laddr net.Addr, name string, handshake func(*net.TCPConn) error) {
+	tcpListener, err := net.ListenTCP(nets, laddr.(*net.TCPAddr))
+	if err != nil {
+		panic(err)
+	}
+	ep.Listener = tcpListener
+	ep.accept = make(chan net.Conn, 64)
+	ep.done = make(chan struct{})
+	go ep.serve(name, handshake)
+}
+
+func (ep *explicitProxy) serve(name string, handshake func(*net.TCPConn) error) {
+	defer close(ep.done)
+	for {
+		conn, err := ep.Listener.AcceptTCP()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go func() {
+			if err := handshake(conn); err != nil {
+				log.Printf("[ERR] %v handshake with %v failed: %v\n", name, conn.RemoteAddr(), err)
+				conn.Close()
+			}
+		}()
+	}
+}
+
+//push hands a connection to Accept.
+func (ep *explicitProxy) push(conn net.Conn) {
+	select {
+	case ep.accept <- conn:
+	case <-ep.done:
+		conn.Close()
+	}
+}
+
+//Accept returns the next connection that completed its handshake. The
+//returned file descriptor is always -1 since the destination is already
+//known.
+func (ep *explicitProxy) Accept() (fd int, conn net.Conn, err error) {
+	select {
+	case conn = <-ep.accept:
+		return -1, conn, nil
+	case <-ep.done:
+		return -1, nil, net.ErrClosed
+	}
+}
+
+func (ep *explicitProxy) Close() error {
+	return ep.Listener.Close()
+}
+
+//ProxyConn is a connection from a client that told Trudy its destination
+//itself, e.g. with a SOCKS or HTTP CONNECT request.
+type ProxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	dest   string
+
+	//reply, if set, answers the client's request once the pipe has dialed
+	//its destination.
+	reply func(bound net.Addr, err error) error
+}
+
+//ReportDial answers the client's request with the outcome of dialing its
+//destination: bound is the local address of the server connection, or err
+//is why there is none. ProxyConn implements pipe.DialReporter, so the pipe
+//calls ReportDial once it has dialed. Only the first call answers the client.
+func (c *ProxyConn) ReportDial(bound net.Addr, err error) error {
+	reply := c.reply
+	c.reply = nil
+	if reply == nil {
+		return nil
+	}
+	return reply(bound, err)
+}
+
+//Read reads data from the connection, starting with anything the client sent
+//along with its proxy request.
+func (c *ProxyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+//Peek returns the next n bytes without reading them.
+func (c *ProxyConn) Peek(n int) ([]byte, error) {
+	return c.reader.Peek(n)
+}
+
+//Destination returns the "host:port" the client asked to connect to. The
+//host may be a hostname.
+func (c *ProxyConn) Destination() string {
+	return c.dest
+}
+
+//NetConn returns the connection ProxyConn wraps.
+func (c *ProxyConn) NetConn() net.Conn {
+	return c.Conn
+}
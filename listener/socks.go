@@ -0,0 +1,351 @@
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+//SOCKS5 protocol values (RFC 1928 and RFC 1929).
+const (
+	socksVersion = 0x05
+
+	socksNoAuth       = 0x00
+	socksUserPassAuth = 0x02
+	socksNoAcceptable = 0xff
+
+	socksConnect      = 0x01
+	socksUDPAssociate = 0x03
+
+	socksIPv4   = 0x01
+	socksDomain = 0x03
+	socksIPv6   = 0x04
+
+	socksSucceeded          = 0x00
+	socksGeneralFailure     = 0x01
+	socksNetworkUnreachable = 0x03
+	socksHostUnreachable    = 0x04
+	socksConnectionRefused  = 0x05
+	socksCommandUnsupported = 0x07
+	socksAddressUnsupported = 0x08
+)
+
+//SOCKSListener implements the TrudyListener interface for clients that are
+//explicitly configured to use Trudy as a SOCKS5 proxy. CONNECT requests are
+//handed to Accept as TCP connections, and UDP ASSOCIATE requests are handed
+//to Accept as one UDPFlow per destination. Either way, the returned
+//connection carries the destination the client asked for, so no help from
+//netfilter is needed. If Username is set, clients must authenticate with it
+//and Password.
+type SOCKSListener struct {
+	explicitProxy
+	Username string
+	Password string
+}
+
+func (sl *SOCKSListener) Listen(nets string, laddr net.Addr, _ *tls.Config) {
+	sl.listen(nets, laddr, "SOCKS", sl.handshake)
+}
+
+func (sl *SOCKSListener) handshake(conn *net.TCPConn) (err error) {
+	r := bufio.NewReader(conn)
+
+	//Method negotiation.
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	if header[0] != socksVersion {
+		return errors.New("unsupported SOCKS version " + strconv.Itoa(int(header[0])))
+	}
+	methods := make([]byte, header[1])
+	if _, err = io.ReadFull(r, methods); err != nil {
+		return
+	}
+	method := byte(socksNoAuth)
+	if sl.Username != "" {
+		method = socksUserPassAuth
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == method
+	}
+	if !offered {
+		conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return errors.New("client did not offer an acceptable authentication method")
+	}
+	if _, err = conn.Write([]byte{socksVersion, method}); err != nil {
+		return
+	}
+	if method == socksUserPassAuth {
+		if err = sl.authenticate(r, conn); err != nil {
+			return
+		}
+	}
+
+	//Request.
+	request := make([]byte, 3)
+	if _, err = io.ReadFull(r, request); err != nil {
+		return
+	}
+	dest, err := readSOCKSAddr(r)
+	if err != nil {
+		socksReply(conn, socksAddressUnsupported, nil)
+		return
+	}
+	switch request[1] {
+	case socksConnect:
+		//The server end of the pipe is dialed after Accept, so the
+		//client is answered once the pipe reports how that went.
+		sl.push(&ProxyConn{Conn: conn, reader: r, dest: dest,
+			reply: func(bound net.Addr, err error) error {
+				if err != nil {
+					return socksReply(conn, socksStatus(err), nil)
+				}
+				return socksReply(conn, socksSucceeded, bound)
+			}})
+	case socksUDPAssociate:
+		err = sl.associate(conn)
+	default:
+		socksReply(conn, socksCommandUnsupported, nil)
+		err = errors.New("unsupported SOCKS command " + strconv.Itoa(int(request[1])))
+	}
+	return
+}
+
+//authenticate performs RFC 1929 username/password authentication.
+func (sl *SOCKSListener) authenticate(r *bufio.Reader, conn net.Conn) (err error) {
+	version, err := r.ReadByte()
+	if err != nil {
+		return
+	}
+	username, err := readSOCKSString(r)
+	if err != nil {
+		return
+	}
+	password, err := readSOCKSString(r)
+	if err != nil {
+		return
+	}
+	if version != 0x01 || username != sl.Username || password != sl.Password {
+		conn.Write([]byte{0x01, 0x01})
+		return errors.New("invalid SOCKS credentials")
+	}
+	_, err = conn.Write([]byte{0x01, 0x00})
+	return
+}
+
+//associate sets up a UDP relay for a UDP ASSOCIATE request. The association
+//lives for as long as the TCP connection that requested it.
+func (sl *SOCKSListener) associate(conn *net.TCPConn) (err error) {
+	local := conn.LocalAddr().(*net.TCPAddr)
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		return
+	}
+	if err = socksReply(conn, socksSucceeded, relay.LocalAddr()); err != nil {
+		relay.Close()
+		return
+	}
+	association := &socksAssociation{listener: sl,
+		relay:  relay,
+		client: conn.RemoteAddr().(*net.TCPAddr).IP,
+		flows:  make(map[string]*UDPFlow),
+		mutex:  new(sync.Mutex)}
+	go association.serve()
+
+	//Nothing more is expected on the TCP connection. Once it closes, the
+	//association ends.
+	io.Copy(io.Discard, conn)
+	conn.Close()
+	association.close()
+	return nil
+}
+
+//socksAssociation relays the datagrams of a single UDP ASSOCIATE request.
+type socksAssociation struct {
+	listener *SOCKSListener
+	relay    *net.UDPConn
+	client   net.IP
+	flows    map[string]*UDPFlow
+	mutex    *sync.Mutex
+}
+
+func (sa *socksAssociation) serve() {
+	buffer := make([]byte, 65535)
+	for {
+		n, src, err := sa.relay.ReadFromUDP(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		//Only the client that made the association may use the relay.
+		if !src.IP.Equal(sa.client) {
+			continue
+		}
+		//Fragmented datagrams are not supported and are dropped.
+		if n < 4 || buffer[2] != 0x00 {
+			continue
+		}
+		r := bytes.NewReader(buffer[3:n])
+		dest, err := readSOCKSAddr(r)
+		if err != nil {
+			continue
+		}
+		payload := buffer[n-r.Len() : n]
+
+		key := src.String() + "->" + dest
+		sa.mutex.Lock()
+		flow, ok := sa.flows[key]
+		if !ok {
+			flow = newUDPFlow(key, sa, sa.relay.LocalAddr(), src, dest)
+			sa.flows[key] = flow
+		}
+		sa.mutex.Unlock()
+
+		if !ok {
+			sa.listener.push(flow)
+		}
+		flow.deliver(payload)
+	}
+}
+
+//send wraps a datagram from the server in a SOCKS UDP header and relays it to
+//the client.
+func (sa *socksAssociation) send(flow *UDPFlow, b []byte) (int, error) {
+	header := append([]byte{0x00, 0x00, 0x00}, socksAddr(flow.dest)...)
+	n, err := sa.relay.WriteToUDP(append(header, b...), flow.client)
+	n -= len(header)
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+func (sa *socksAssociation) remove(flow *UDPFlow) {
+	sa.mutex.Lock()
+	if sa.flows[flow.key] == flow {
+		delete(sa.flows, flow.key)
+	}
+	sa.mutex.Unlock()
+}
+
+//close ends the association and every flow that belongs to it.
+func (sa *socksAssociation) close() {
+	sa.relay.Close()
+	sa.mutex.Lock()
+	flows := make([]*UDPFlow, 0, len(sa.flows))
+	for _, flow := range sa.flows {
+		flows = append(flows, flow)
+	}
+	sa.mutex.Unlock()
+	for _, flow := range flows {
+		flow.Close()
+	}
+}
+
+//byteReader is satisfied by both *bufio.Reader and *bytes.Reader.
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+//readSOCKSAddr reads an ATYP, DST.ADDR and DST.PORT triple and returns it as a
+//"host:port" connection string.
+func readSOCKSAddr(r byteReader) (addr string, err error) {
+	atyp, err := r.ReadByte()
+	if err != nil {
+		return
+	}
+	var host string
+	switch atyp {
+	case socksIPv4, socksIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp == socksIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err = io.ReadFull(r, ip); err != nil {
+			return
+		}
+		host = ip.String()
+	case socksDomain:
+		if host, err = readSOCKSString(r); err != nil {
+			return
+		}
+	default:
+		return "", errors.New("unsupported SOCKS address type " + strconv.Itoa(int(atyp)))
+	}
+	port := make([]byte, 2)
+	if _, err = io.ReadFull(r, port); err != nil {
+		return
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+//readSOCKSString reads a single length-prefixed string.
+func readSOCKSString(r byteReader) (string, error) {
+	length, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, length)
+	_, err = io.ReadFull(r, b)
+	return string(b), err
+}
+
+//socksAddr encodes a "host:port" connection string as an ATYP, ADDR and PORT
+//triple.
+func socksAddr(addr string) []byte {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return []byte{socksIPv4, 0, 0, 0, 0, 0, 0}
+	}
+	port, _ := strconv.Atoi(portString)
+	var b []byte
+	if ip := net.ParseIP(host); ip == nil {
+		b = append([]byte{socksDomain, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append([]byte{socksIPv4}, ip4...)
+	} else {
+		b = append([]byte{socksIPv6}, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+//socksStatus returns the reply code that tells a SOCKS client why its
+//destination could not be reached.
+func socksStatus(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return socksHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return socksHostUnreachable
+	}
+	return socksGeneralFailure
+}
+
+//socksReply sends a reply to a SOCKS request. A nil bound address is sent as
+//0.0.0.0:0.
+func socksReply(conn net.Conn, status byte, bound net.Addr) error {
+	addr := "0.0.0.0:0"
+	if bound != nil {
+		addr = bound.String()
+	}
+	_, err := conn.Write(append([]byte{socksVersion, status, 0x00}, socksAddr(addr)...))
+	return err
+}
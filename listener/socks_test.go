@@ -0,0 +1,172 @@
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReadSOCKSAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		want string
+		err  bool
+	}{
+		{name: "IPv4", b: []byte{socksIPv4, 10, 0, 0, 5, 0x01, 0xbb}, want: "10.0.0.5:443"},
+		{name: "IPv6", b: append(append([]byte{socksIPv6}, net.ParseIP("2001:db8::1")...), 0x1f, 0x90),
+			want: "[2001:db8::1]:8080"},
+		{name: "domain", b: append(append([]byte{socksDomain, 11}, "example.com"...), 0x00, 0x50),
+			want: "example.com:80"},
+		{name: "unknown type", b: []byte{0x02, 10, 0, 0, 5, 0x01, 0xbb}, err: true},
+		{name: "short address", b: []byte{socksIPv4, 10, 0}, err: true},
+		{name: "short domain", b: []byte{socksDomain, 11, 'e', 'x'}, err: true},
+		{name: "no port", b: []byte{socksIPv4, 10, 0, 0, 5}, err: true},
+		{name: "empty", b: nil, err: true},
+	}
+	for _, test := range tests {
+		got, err := readSOCKSAddr(bytes.NewReader(test.b))
+		if test.err {
+			if err == nil {
+				t.Errorf("%v: got %q, want an error", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+		} else if got != test.want {
+			t.Errorf("%v: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSOCKSAddrRoundTrip(t *testing.T) {
+	for _, addr := range []string{"10.0.0.5:443", "[2001:db8::1]:8080", "example.com:80"} {
+		got, err := readSOCKSAddr(bytes.NewReader(socksAddr(addr)))
+		if err != nil || got != addr {
+			t.Errorf("%v: got %q, %v", addr, got, err)
+		}
+	}
+}
+
+func TestSOCKSStatus(t *testing.T) {
+	dial := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}
+	}
+	tests := []struct {
+		err  error
+		want byte
+	}{
+		{dial(syscall.ECONNREFUSED), socksConnectionRefused},
+		{dial(syscall.ENETUNREACH), socksNetworkUnreachable},
+		{dial(syscall.EHOSTUNREACH), socksHostUnreachable},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "nowhere.invalid"}}, socksHostUnreachable},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, socksHostUnreachable},
+		{errors.New("refused by a module"), socksGeneralFailure},
+	}
+	for _, test := range tests {
+		if got := socksStatus(test.err); got != test.want {
+			t.Errorf("%v: got %#x, want %#x", test.err, got, test.want)
+		}
+	}
+}
+
+//dialSOCKS connects to the SOCKS listener at addr and asks it for a
+//CONNECT to dest.
+func dialSOCKS(t *testing.T, addr net.Addr, dest string) net.Conn {
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte{socksVersion, 1, socksNoAuth})
+	method := make([]byte, 2)
+	if _, err = io.ReadFull(conn, method); err != nil || method[1] != socksNoAuth {
+		t.Fatalf("method negotiation failed: %v %v", method, err)
+	}
+	conn.Write(append([]byte{socksVersion, socksConnect, 0x00}, socksAddr(dest)...))
+	return conn
+}
+
+func TestSOCKSConnectReply(t *testing.T) {
+	sl := new(SOCKSListener)
+	sl.Listen("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, nil)
+	defer sl.Close()
+
+	tests := []struct {
+		name  string
+		err   error
+		bound net.Addr
+		want  byte
+	}{
+		{name: "refused", err: syscall.ECONNREFUSED, want: socksConnectionRefused},
+		{name: "connected", bound: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4000}, want: socksSucceeded},
+	}
+	for _, test := range tests {
+		client := dialSOCKS(t, sl.Listener.Addr(), "example.com:80")
+		_, conn, err := sl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := conn.(*ProxyConn).Destination(); got != "example.com:80" {
+			t.Errorf("%v: destination is %q", test.name, got)
+		}
+
+		//Nothing is sent before the pipe reports how dialing went.
+		client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if n, err := client.Read(make([]byte, 1)); n != 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("%v: got a reply before the dial: %v %v", test.name, n, err)
+		}
+
+		conn.(*ProxyConn).ReportDial(test.bound, test.err)
+		conn.(*ProxyConn).ReportDial(nil, errors.New("answered twice"))
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reply := make([]byte, 3)
+		if _, err := io.ReadFull(client, reply); err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if reply[1] != test.want {
+			t.Errorf("%v: got reply %#x, want %#x", test.name, reply[1], test.want)
+		}
+		bound, err := readSOCKSAddr(bufio.NewReader(client))
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+		} else if test.bound != nil && bound != test.bound.String() {
+			t.Errorf("%v: got bound address %v, want %v", test.name, bound, test.bound)
+		}
+		client.Close()
+		conn.Close()
+	}
+}
+
+func TestConnectDestination(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"example.com:8443", "example.com:8443"},
+		{"example.com", "example.com:443"},
+		{"10.0.0.5:80", "10.0.0.5:80"},
+		{"[2001:db8::1]:80", "[2001:db8::1]:80"},
+		{"[::1]", "[::1]:443"},
+	}
+	for _, test := range tests {
+		request := fmt.Sprintf("CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", test.host, test.host)
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(request)))
+		if err != nil {
+			t.Fatalf("%v: %v", test.host, err)
+		}
+		if got := connectDestination(req); got != test.want {
+			t.Errorf("%v: got %q, want %q", test.host, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package listener
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+//TProxyListener implements the TrudyListener interface for connections
+//delivered by an iptables TPROXY rule. The listening socket is transparent, so
+//the kernel hands it connections addressed to other hosts without rewriting
+//their destination. The original destination of an accepted connection is
+//simply its local address. If Listen is given a tls.Config, accepted
+//connections are wrapped in TLS like the TLSListener does.
+type TProxyListener struct {
+	Listener *net.TCPListener
+	Config   *tls.Config
+	//Spoof makes Trudy connect to the server from the client's IP address
+	//instead of its own.
+	Spoof bool
+}
+
+func (tl *TProxyListener) Listen(nets string, laddr net.Addr, config *tls.Config) {
+	lc := net.ListenConfig{Control: transparentControl}
+	l, err := lc.Listen(context.Background(), nets, laddr.(*net.TCPAddr).String())
+	if err != nil {
+		panic(err)
+	}
+	tl.Listener = l.(*net.TCPListener)
+	tl.Config = config
+}
+
+func (tl *TProxyListener) Accept() (fd int, conn net.Conn, err error) {
+	fd, tcpConn, err := acceptTCP(tl.Listener)
+	if err != nil {
+		return
+	}
+	if tl.Config != nil {
+		conn = tls.Server(&TProxyConn{Conn: newPeekedConn(tcpConn), Spoof: tl.Spoof}, tl.Config)
+	} else {
+		conn = &TProxyConn{Conn: tcpConn, Spoof: tl.Spoof}
+	}
+	return
+}
+
+func (tl *TProxyListener) Close() error {
+	return tl.Listener.Close()
+}
+
+//TProxyConn is a connection accepted by a TProxyListener.
+type TProxyConn struct {
+	net.Conn
+	Spoof bool
+}
+
+//Destination returns the client's original destination, which for a TPROXY
+//connection is the local address of the accepted socket.
+func (c *TProxyConn) Destination() string {
+	return c.LocalAddr().String()
+}
+
+//SourceAddr returns the client's address if the connection to the server
+//should be made from it, or nil if Trudy should use its own address.
+func (c *TProxyConn) SourceAddr() net.Addr {
+	if !c.Spoof {
+		return nil
+	}
+	return c.RemoteAddr()
+}
+
+//NetConn returns the connection TProxyConn wraps.
+func (c *TProxyConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,333 @@
+package listener
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"golang.org/x/sys/unix"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//UDPListener implements the TrudyListener interface for UDP. UDP has no
+//notion of a connection, so UDPListener tracks flows (a client address paired
+//with the client's original destination) and hands each new flow to Accept as
+//a net.Conn. Traffic must be delivered to the listener with an iptables TPROXY
+//rule so the kernel can report the original destination of every datagram.
+type UDPListener struct {
+	Conn   *net.UDPConn
+	flows  map[string]*UDPFlow
+	mutex  *sync.Mutex
+	accept chan *UDPFlow
+}
+
+//isIPv6 reports whether network refers to an IPv6 (or dual-stack) socket.
+func isIPv6(network string) bool {
+	return strings.HasSuffix(network, "6")
+}
+
+//transparentControl marks a socket as transparent. A transparent socket can
+//receive datagrams addressed to other hosts and can send datagrams from a
+//non-local address.
+func transparentControl(network, address string, c syscall.RawConn) (err error) {
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+		if err == nil && isIPv6(network) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+		}
+		if err != nil {
+			return
+		}
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return
+}
+
+func (ul *UDPListener) Listen(nets string, laddr net.Addr, _ *tls.Config) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) (err error) {
+		err = transparentControl(network, address, c)
+		if err != nil {
+			return
+		}
+		cerr := c.Control(func(fd uintptr) {
+			//IPv4 datagrams arriving on a dual-stack socket still carry
+			//an IP_ORIGDSTADDR control message.
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1)
+			if err == nil && isIPv6(network) {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1)
+			}
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return
+	}}
+	conn, err := lc.ListenPacket(context.Background(), nets, laddr.(*net.UDPAddr).String())
+	if err != nil {
+		panic(err)
+	}
+	ul.Conn = conn.(*net.UDPConn)
+	ul.flows = make(map[string]*UDPFlow)
+	ul.mutex = new(sync.Mutex)
+	ul.accept = make(chan *UDPFlow, 64)
+	go ul.serve()
+}
+
+//Accept returns the next new UDP flow. The returned file descriptor is always
+//-1 since a flow does not own a socket of its own.
+func (ul *UDPListener) Accept() (fd int, conn net.Conn, err error) {
+	flow, ok := <-ul.accept
+	if !ok {
+		return -1, nil, net.ErrClosed
+	}
+	return -1, flow, nil
+}
+
+func (ul *UDPListener) Close() error {
+	return ul.Conn.Close()
+}
+
+//serve reads every datagram delivered to the listening socket and routes it
+//to the flow it belongs to, creating the flow if needed.
+func (ul *UDPListener) serve() {
+	defer close(ul.accept)
+	buffer := make([]byte, 65535)
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, src, err := ul.Conn.ReadMsgUDP(buffer, oob)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		dst, err := originalDestination(oob[:oobn])
+		if err != nil {
+			log.Printf("[ERR] Could not determine original destination of UDP datagram from %v: %v\n", src, err)
+			continue
+		}
+
+		key := src.String() + "->" + dst.String()
+		ul.mutex.Lock()
+		flow, ok := ul.flows[key]
+		if !ok {
+			flow, err = ul.newFlow(key, src, dst)
+			if err != nil {
+				ul.mutex.Unlock()
+				log.Printf("[ERR] Could not create UDP flow %v: %v\n", key, err)
+				continue
+			}
+			ul.flows[key] = flow
+		}
+		ul.mutex.Unlock()
+
+		if !ok {
+			ul.accept <- flow
+		}
+		flow.deliver(buffer[:n])
+	}
+}
+
+//newFlow builds a UDPFlow. Replies to the client are sent from a transparent
+//socket bound to the original destination, so the client sees responses
+//coming from the server it intended to talk to.
+func (ul *UDPListener) newFlow(key string, src, dst *net.UDPAddr) (flow *UDPFlow, err error) {
+	dialer := net.Dialer{LocalAddr: dst, Control: transparentControl}
+	reply, err := dialer.Dial("udp", src.String())
+	if err != nil {
+		return
+	}
+	flow = newUDPFlow(key, ul, dst, src, dst.String())
+	flow.reply = reply.(*net.UDPConn)
+	go flow.pump()
+	return
+}
+
+func (ul *UDPListener) send(flow *UDPFlow, b []byte) (int, error) {
+	return flow.reply.Write(b)
+}
+
+func (ul *UDPListener) remove(flow *UDPFlow) {
+	flow.reply.Close()
+	ul.mutex.Lock()
+	if ul.flows[flow.key] == flow {
+		delete(ul.flows, flow.key)
+	}
+	ul.mutex.Unlock()
+}
+
+//originalDestination extracts the original destination of a datagram from
+//the IP_ORIGDSTADDR or IPV6_ORIGDSTADDR control message.
+func originalDestination(oob []byte) (addr *net.UDPAddr, err error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return
+	}
+	for _, msg := range msgs {
+		//The control message holds a sockaddr_in or sockaddr_in6: the port
+		//is in network byte order after the two byte family.
+		sa := msg.Data
+		switch {
+		case msg.Header.Level == syscall.SOL_IP && msg.Header.Type == syscall.IP_ORIGDSTADDR &&
+			len(sa) >= syscall.SizeofSockaddrInet4:
+			addr = &net.UDPAddr{IP: net.IPv4(sa[4], sa[5], sa[6], sa[7]),
+				Port: int(sa[2])<<8 + int(sa[3])}
+			return
+		case msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == unix.IPV6_ORIGDSTADDR &&
+			len(sa) >= syscall.SizeofSockaddrInet6:
+			//sockaddr_in6 has four bytes of flow information before
+			//the address.
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, sa[8:24])
+			addr = &net.UDPAddr{IP: ip, Port: int(sa[2])<<8 + int(sa[3])}
+			return
+		}
+	}
+	return nil, errors.New("no original destination in control message")
+}
+
+//flowOwner is implemented by the listeners that hand out UDPFlows. The owner
+//sends a flow's datagrams to the client and forgets the flow once it closes.
+type flowOwner interface {
+	send(flow *UDPFlow, b []byte) (int, error)
+	remove(flow *UDPFlow)
+}
+
+//UDPFlow is a pseudo-connection representing a single UDP flow between a
+//client and its original destination. UDPFlow implements net.Conn. For flows
+//accepted by a UDPListener, LocalAddr returns the client's original
+//destination just like a TPROXY socket would. RemoteAddr returns the client.
+type UDPFlow struct {
+	key      string
+	owner    flowOwner
+	reply    *net.UDPConn
+	local    net.Addr
+	client   *net.UDPAddr
+	dest     string
+	in       chan []byte
+	done     chan struct{}
+	once     sync.Once
+	mutex    *sync.Mutex
+	deadline time.Time
+}
+
+func newUDPFlow(key string, owner flowOwner, local net.Addr, client *net.UDPAddr, dest string) *UDPFlow {
+	return &UDPFlow{key: key,
+		owner:  owner,
+		local:  local,
+		client: client,
+		dest:   dest,
+		in:     make(chan []byte, 64),
+		done:   make(chan struct{}),
+		mutex:  new(sync.Mutex)}
+}
+
+//deliver queues a datagram for Read. If the flow is not keeping up, the
+//datagram is dropped, just like the kernel would.
+func (f *UDPFlow) deliver(b []byte) {
+	datagram := make([]byte, len(b))
+	copy(datagram, b)
+	select {
+	case f.in <- datagram:
+	case <-f.done:
+	default:
+	}
+}
+
+//pump delivers datagrams that the kernel routes to the reply socket instead
+//of the listening socket.
+func (f *UDPFlow) pump() {
+	buffer := make([]byte, 65535)
+	for {
+		n, err := f.reply.Read(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		f.deliver(buffer[:n])
+	}
+}
+
+//Read reads a single datagram sent by the client. If the buffer is smaller
+//than the datagram the excess is discarded.
+func (f *UDPFlow) Read(b []byte) (n int, err error) {
+	f.mutex.Lock()
+	deadline := f.deadline
+	f.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case datagram := <-f.in:
+		n = copy(b, datagram)
+	case <-timeout:
+		err = os.ErrDeadlineExceeded
+	case <-f.done:
+		err = net.ErrClosed
+	}
+	return
+}
+
+//Write sends a single datagram to the client as if it came from the original
+//destination.
+func (f *UDPFlow) Write(b []byte) (n int, err error) {
+	return f.owner.send(f, b)
+}
+
+//Close tears down the flow. Datagrams received for the same client and
+//destination afterwards will create a new flow.
+func (f *UDPFlow) Close() error {
+	f.once.Do(func() {
+		close(f.done)
+		f.owner.remove(f)
+	})
+	return nil
+}
+
+//Destination returns the client's original destination as a "host:port"
+//connection string.
+func (f *UDPFlow) Destination() string {
+	return f.dest
+}
+
+func (f *UDPFlow) LocalAddr() net.Addr {
+	return f.local
+}
+
+//RemoteAddr returns the address of the client.
+func (f *UDPFlow) RemoteAddr() net.Addr {
+	return f.client
+}
+
+func (f *UDPFlow) SetDeadline(t time.Time) error {
+	f.SetReadDeadline(t)
+	return f.SetWriteDeadline(t)
+}
+
+func (f *UDPFlow) SetReadDeadline(t time.Time) error {
+	f.mutex.Lock()
+	f.deadline = t
+	f.mutex.Unlock()
+	return nil
+}
+
+func (f *UDPFlow) SetWriteDeadline(t time.Time) error {
+	if f.reply == nil {
+		return nil
+	}
+	return f.reply.SetWriteDeadline(t)
+}
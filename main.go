@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bufio"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"flag"
 	"fmt"
 	"github.com/gorilla/websocket"
+	"github.com/praetorian-inc/trudy/ca"
 	"github.com/praetorian-inc/trudy/listener"
 	"github.com/praetorian-inc/trudy/module"
 	"github.com/praetorian-inc/trudy/pipe"
@@ -13,49 +19,303 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var connectionCount uint
+//connectionCount is the id of the next pipe. Every listener has a dispatcher
+//of its own, so it is only accessed atomically.
+var connectionCount uint64
+
+//defaultChain is the chain of modules given with -modules. listenerChains
+//and destinationChains hold the chains of the listeners and destinations that
+//have their own in the config file, keyed by listener name and by the
+//destination's settings.
+var defaultChain module.Chain
+var listenerChains = make(map[string]module.Chain)
+var destinationChains = make(map[*pipe.DestinationConfig]module.Chain)
+
+//listenerNames are the names of the listeners, as used in the config file.
+var listenerNames = []string{"TCP", "TLS", "UDP", "SOCKS", "CONNECT"}
+
+//knownListener reports whether name, in any case, is one of listenerNames.
+func knownListener(name string) bool {
+	for _, known := range listenerNames {
+		if strings.EqualFold(name, known) {
+			return true
+		}
+	}
+	return false
+}
+
 var websocketConn *websocket.Conn
 var websocketMutex *sync.Mutex
 var tlsConfig *tls.Config
+var clientCertDir string
 
-func main() {
-	var tcpport string
-	var tlsport string
+//options holds Trudy's command line configuration.
+type options struct {
+	tcpport     string
+	tlsport     string
+	udpport     string
+	socksport   string
+	socksuser   string
+	sockspass   string
+	connectport string
+	connecttls  bool
+	forward     forwards
+	detecttls   bool
+	detectwait  time.Duration
+	starttls    bool
+
+	x509   string
+	key    string
+	mint   bool
+	clone  bool
+	cacert string
+	cakey  string
+	keylog string
+	config string
+
+	mirror        bool
+	autopass      bool
+	failedhosts   string
+	clientauth    bool
+	clientcertdir string
+
+	impair  pipe.Impairment
+	modules string
+
+	show   bool
+	tproxy bool
+	spoof  bool
+}
+
+//forwards maps listening ports (e.g. ":6666") to the upstream "host:port"
+//their connections are forwarded to. forwards implements flag.Value so the
+//-forward flag can be repeated.
+type forwards map[string]string
+
+func (f forwards) String() string {
+	var pairs []string
+	for port, upstream := range f {
+		pairs = append(pairs, strings.TrimPrefix(port, ":")+"="+upstream)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f forwards) Set(value string) error {
+	port, upstream, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("%q is not in the form port=host:port", value)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid listening port %q", port)
+	}
+	if _, _, err := net.SplitHostPort(upstream); err != nil {
+		return err
+	}
+	f[":"+port] = upstream
+	return nil
+}
+
+//config is the format of the JSON file given with -config.
+type config struct {
+	//Destinations maps "host:port", "host", ":port" or "*" to the
+	//settings for pipes to matching destinations.
+	Destinations map[string]*pipe.DestinationConfig `json:"destinations"`
+
+	//Devices maps client IP addresses to the settings for pipes from
+	//those devices.
+	Devices map[string]*pipe.DeviceConfig `json:"devices"`
+
+	//Listeners maps listener names ("TCP", "TLS", "UDP", "SOCKS" or
+	//"CONNECT") to the settings for pipes accepted by those listeners.
+	Listeners map[string]*listenerConfig `json:"listeners"`
+}
 
-	var x509 string
-	var key string
+//listenerConfig holds the settings for pipes accepted by a listener.
+type listenerConfig struct {
+	//Modules names the modules, in order, that data passes through
+	//instead of those given with -modules.
+	Modules []string `json:"modules"`
+}
+
+//loadConfig reads the config file at path and applies it.
+func loadConfig(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var c config
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&c); err != nil {
+		return err
+	}
+	if err = pipe.Configure(c.Destinations); err != nil {
+		return err
+	}
+	for dest, config := range c.Destinations {
+		if config.Modules == nil {
+			continue
+		}
+		chain, err := module.NewChain(config.Modules)
+		if err != nil {
+			return fmt.Errorf("%v: %v", dest, err)
+		}
+		destinationChains[config] = chain
+	}
+	for name, config := range c.Listeners {
+		if !knownListener(name) {
+			return fmt.Errorf("unknown listener %q (available: %v)", name, strings.Join(listenerNames, ", "))
+		}
+		chain, err := module.NewChain(config.Modules)
+		if err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+		listenerChains[strings.ToUpper(name)] = chain
+	}
+	return pipe.ConfigureDevices(c.Devices)
+}
 
-	var showConnectionAttempts bool
+//loadFailedHosts reads the hosts recorded in the file at path by earlier runs
+//and records new ones in it.
+func loadFailedHosts(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if host := strings.TrimSpace(scanner.Text()); host != "" {
+			pipe.AddFailedHost(host)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	pipe.FailedHostsWriter = f
+	return nil
+}
+
+func main() {
+	opts := options{forward: make(forwards)}
 
-	flag.StringVar(&tcpport, "tcp", "6666", "Listening port for non-TLS connections.")
-	flag.StringVar(&tlsport, "tls", "6443", "Listening port for TLS connections.")
-	flag.StringVar(&x509, "x509", "./certificate/trudy.cer", "Path to x509 certificate that will be presented for TLS connection.")
-	flag.StringVar(&key, "key", "./certificate/trudy.key", "Path to the corresponding private key for the specified x509 certificate")
-	flag.BoolVar(&showConnectionAttempts, "show", true, "Show connection open and close messages")
+	flag.StringVar(&opts.tcpport, "tcp", "6666", "Listening port for non-TLS connections.")
+	flag.StringVar(&opts.tlsport, "tls", "6443", "Listening port for TLS connections.")
+	flag.StringVar(&opts.udpport, "udp", "", "Listening port for UDP traffic delivered by an iptables TPROXY rule. UDP proxying is disabled if empty.")
+	flag.StringVar(&opts.socksport, "socks", "", "Listening port for clients explicitly configured to use Trudy as a SOCKS5 proxy. The SOCKS proxy is disabled if empty.")
+	flag.StringVar(&opts.socksuser, "socksuser", "", "Username SOCKS clients must authenticate with. Authentication is not required if empty.")
+	flag.StringVar(&opts.sockspass, "sockspass", "", "Password SOCKS clients must authenticate with.")
+	flag.StringVar(&opts.connectport, "connect", "", "Listening port for clients explicitly configured to use Trudy as an HTTP proxy (HTTP CONNECT). The HTTP proxy is disabled if empty.")
+	flag.BoolVar(&opts.connecttls, "connecttls", false, "Terminate TLS inside HTTP CONNECT tunnels using the x509 certificate.")
+	flag.BoolVar(&opts.detecttls, "detecttls", false, "Detect TLS ClientHellos on the TCP listener and terminate TLS for those connections using the x509 certificate. Connections where the server speaks first are delayed by -detecttimeout.")
+	flag.DurationVar(&opts.detectwait, "detecttimeout", listener.DefaultDetectTimeout, "How long the TCP listener waits for a TLS ClientHello before treating a connection as plaintext.")
+	flag.BoolVar(&opts.starttls, "starttls", false, "Intercept STARTTLS upgrades (SMTP, IMAP, POP3, XMPP and PostgreSQL) on plaintext connections and terminate TLS on both ends using the x509 certificate.")
+	flag.Var(opts.forward, "forward", "Forward every connection on a listening port to a fixed upstream instead of its original destination, e.g. 6666=10.0.0.5:1883. Ports other than the TCP and TLS ports get a TCP listener of their own. May be repeated.")
+	flag.DurationVar(&pipe.UDPFlowTimeout, "udpidle", pipe.UDPFlowTimeout, "Close UDP flows that have been idle for this long.")
+	flag.DurationVar(&pipe.DefaultTimeouts.Idle, "idletimeout", pipe.DefaultTimeouts.Idle, "Close TCP pipes once neither end has sent anything for this long. 0 disables the timeout.")
+	flag.DurationVar(&pipe.DefaultTimeouts.Read, "readtimeout", pipe.DefaultTimeouts.Read, "Close TCP pipes once either end has sent nothing for this long. 0 disables the timeout.")
+	flag.DurationVar(&pipe.DefaultTimeouts.Write, "writetimeout", pipe.DefaultTimeouts.Write, "Close pipes when a write to either end blocks for this long. 0 disables the timeout.")
+	flag.DurationVar(&pipe.DefaultTimeouts.Handshake, "handshaketimeout", pipe.DefaultTimeouts.Handshake, "Close TLS connections whose handshake, with either end, takes longer than this. 0 disables the timeout.")
+	flag.DurationVar(&pipe.DefaultTimeouts.Dial, "dialtimeout", pipe.DefaultTimeouts.Dial, "Give up connecting to a destination after this long. 0 leaves it to the operating system.")
+	flag.DurationVar(&pipe.DefaultTimeouts.KeepAlive, "keepalive", pipe.DefaultTimeouts.KeepAlive, "TCP keepalive period for both ends of a pipe. 0 disables keepalives.")
+	flag.DurationVar((*time.Duration)(&opts.impair.Latency), "latency", 0, "Delay every chunk of data in both directions by this long.")
+	flag.DurationVar((*time.Duration)(&opts.impair.Jitter), "jitter", 0, "Vary the -latency of every chunk by up to this long either way.")
+	flag.Int64Var(&opts.impair.Bandwidth, "bandwidth", 0, "Limit each direction of every pipe to this many bytes per second. 0 means no limit.")
+	flag.Float64Var(&opts.impair.Loss, "loss", 0, "Drop this fraction (0 to 1) of the chunks of data in both directions.")
+	flag.IntVar(&opts.impair.Segment, "segment", 0, "Split chunks of data into writes of at most this many bytes. 0 leaves chunks whole.")
+	flag.StringVar(&opts.x509, "x509", "./certificate/trudy.cer", "Path to x509 certificate that will be presented for TLS connection.")
+	flag.StringVar(&opts.key, "key", "./certificate/trudy.key", "Path to the corresponding private key for the specified x509 certificate")
+	flag.BoolVar(&opts.mint, "mint", false, "Instead of presenting the x509 certificate, mint a certificate for every host from a local CA. Install the CA certificate (served at http://<trudy>:8080/ca.crt) on the device under test.")
+	flag.BoolVar(&opts.clone, "clone", false, "Like -mint, but present a clone of the real server's certificate with the same subject, SANs, issuer name, serial number and validity, signed with the CA key.")
+	flag.StringVar(&opts.cacert, "cacert", "./certificate/ca.cer", "Path to the CA certificate used with -mint and -clone. A new CA is generated if neither it nor the CA key exists.")
+	flag.StringVar(&opts.cakey, "cakey", "./certificate/ca.key", "Path to the private key of the CA certificate used with -mint and -clone.")
+	flag.StringVar(&opts.keylog, "keylog", os.Getenv("SSLKEYLOGFILE"), "Append the TLS secrets of both ends of every pipe to this file in NSS key log format, for decrypting captures with Wireshark. Defaults to $SSLKEYLOGFILE.")
+	flag.BoolVar(&opts.mirror, "mirror", false, "Connect to TLS servers with the SNI, ALPN protocols and TLS versions the client offered, and accept the client with the protocol and version the server selected.")
+	flag.BoolVar(&opts.autopass, "autopassthrough", false, "Pass TLS connections through untouched once a client has rejected Trudy's certificate for the same host.")
+	flag.StringVar(&opts.failedhosts, "failedhosts", "", "Record the hosts whose clients rejected Trudy's certificate in this file. Hosts already in the file are passed through with -autopassthrough.")
+	flag.BoolVar(&opts.clientauth, "clientauth", false, "Ask TLS clients for a client certificate. Presented certificates are logged and available to modules.")
+	flag.StringVar(&opts.clientcertdir, "clientcertdir", "", "Save client certificates presented to Trudy as PEM files in this directory.")
+	flag.StringVar(&opts.modules, "modules", "default", "Comma-separated list of the modules data passes through, in order, or \"none\". \"default\" is the Data methods in module/module.go. The config file can set other modules per listener or destination.")
+	flag.StringVar(&opts.config, "config", "", "Path to a JSON file with per-destination settings. See the README for its format.")
+	flag.BoolVar(&opts.show, "show", true, "Show connection open and close messages")
+	flag.BoolVar(&opts.tproxy, "tproxy", false, "Accept TCP and TLS connections delivered by an iptables TPROXY rule instead of a NAT REDIRECT rule.")
+	flag.BoolVar(&opts.spoof, "spoof", false, "In TPROXY mode, connect to servers from the client's IP address instead of Trudy's.")
 
 	flag.Parse()
 
-	tcpport = ":" + tcpport
-	tlsport = ":" + tlsport
-	setup(tcpport, tlsport, x509, key, showConnectionAttempts)
+	opts.tcpport = ":" + opts.tcpport
+	opts.tlsport = ":" + opts.tlsport
+	if opts.udpport != "" {
+		opts.udpport = ":" + opts.udpport
+	}
+	if opts.socksport != "" {
+		opts.socksport = ":" + opts.socksport
+	}
+	if opts.connectport != "" {
+		opts.connectport = ":" + opts.connectport
+	}
+	setup(opts)
 }
 
-func setup(tcpport, tlsport, x509, key string, show bool) {
+func setup(opts options) {
+
+	//Chain the modules!
+	chain, err := module.ParseChain(opts.modules)
+	if err != nil {
+		log.Printf("There appears to be an error with the modules specified. See error below.\n%v\n", err.Error())
+		return
+	}
+	defaultChain = chain
+	pipe.BeforeDial = beforeDial
+
+	//Load per-destination settings!
+	if opts.config != "" {
+		if err := loadConfig(opts.config); err != nil {
+			log.Printf("There appears to be an error with the config file specified. See error below.\n%v\n", err.Error())
+			return
+		}
+	}
+
+	//Degrade the network, if asked to. Destinations in the config file
+	//may have impairments of their own.
+	if opts.impair != (pipe.Impairment{}) {
+		impairment := opts.impair
+		if err := impairment.Validate(); err != nil {
+			log.Printf("There appears to be an error with the impairments specified. See error below.\n%v\n", err.Error())
+			return
+		}
+		pipe.DefaultImpairments = pipe.Impairments{ToServer: &impairment, ToClient: &impairment}
+	}
+
+	//The TPROXY listener takes every connection to the TCP and TLS ports
+	//to its original destination, and only terminates TLS on the TLS port.
+	if opts.tproxy && (len(opts.forward) > 0 || opts.detecttls) {
+		log.Printf("There appears to be an error with the listener options specified. See error below.\n%v\n", "-tproxy can't be combined with -forward or -detecttls")
+		return
+	}
 
 	//Setup non-TLS TCP listener!
-	tcpAddr, err := net.ResolveTCPAddr("tcp", tcpport)
+	tcpAddr, err := net.ResolveTCPAddr("tcp", opts.tcpport)
 	if err != nil {
 		log.Printf("There appears to be an error with the TCP port you specified. See error below.\n%v\n", err.Error())
 		return
 	}
-	tcpListener := new(listener.TCPListener)
+	var tcpListener listener.TrudyListener = &listener.TCPListener{Upstream: opts.forward[opts.tcpport], DetectTimeout: opts.detectwait}
+	if opts.tproxy {
+		tcpListener = &listener.TProxyListener{Spoof: opts.spoof}
+	}
 
 	//Setup TLS listener!
-	trdy, err := tls.LoadX509KeyPair(x509, key)
+	trdy, err := tls.LoadX509KeyPair(opts.x509, opts.key)
 	if err != nil {
 		log.Printf("There appears to be an error with the x509 or key values specified. See error below.\n%v\n", err.Error())
 		return
@@ -64,24 +324,159 @@ func setup(tcpport, tlsport, x509, key string, show bool) {
 		Certificates:       []tls.Certificate{trdy},
 		InsecureSkipVerify: true,
 	}
-	tlsAddr, err := net.ResolveTCPAddr("tcp", tlsport)
+	if opts.clientauth {
+		tlsConfig.ClientAuth = tls.RequestClientCert
+	}
+	clientCertDir = opts.clientcertdir
+	if opts.mirror {
+		pipe.MirrorTLS(tlsConfig)
+	}
+	pipe.AutoPassthrough = opts.autopass
+	if opts.failedhosts != "" {
+		if err := loadFailedHosts(opts.failedhosts); err != nil {
+			log.Printf("There appears to be an error with the failed hosts file specified. See error below.\n%v\n", err.Error())
+			return
+		}
+	}
+	if opts.keylog != "" {
+		keylog, err := os.OpenFile(opts.keylog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.Printf("There appears to be an error with the key log file specified. See error below.\n%v\n", err.Error())
+			return
+		}
+		tlsConfig.KeyLogWriter = keylog
+		pipe.KeyLogWriter = keylog
+		log.Printf("[INFO] Writing TLS secrets to %v\n", opts.keylog)
+	}
+	if opts.mint || opts.clone {
+		authority, err := ca.Load(opts.cacert, opts.cakey)
+		if err != nil {
+			log.Printf("There appears to be an error with the CA certificate or key specified. See error below.\n%v\n", err.Error())
+			return
+		}
+		authority.Clone = opts.clone
+		//tls.Config only asks GetCertificate for a certificate when
+		//the client sends no SNI if there are no static certificates.
+		tlsConfig.Certificates = nil
+		tlsConfig.GetCertificate = authority.GetCertificate
+		http.HandleFunc("/ca.crt", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+			w.Write(authority.PEM())
+		})
+		log.Printf("[INFO] Minting certificates from the CA at %v. Download it from http://<trudy>:8080/ca.crt\n", opts.cacert)
+	}
+	tlsAddr, err := net.ResolveTCPAddr("tcp", opts.tlsport)
 	if err != nil {
 		log.Printf("There appears to be an error with the TLS port specified. See error below.\n%v\n", err.Error())
 		return
 	}
-	tlsListener := new(listener.TLSListener)
+	var tlsListener listener.TrudyListener = &listener.TLSListener{Upstream: opts.forward[opts.tlsport]}
+	if opts.tproxy {
+		tlsListener = &listener.TProxyListener{Spoof: opts.spoof}
+	}
+
+	//Setup UDP listener!
+	var udpAddr *net.UDPAddr
+	if opts.udpport != "" {
+		udpAddr, err = net.ResolveUDPAddr("udp", opts.udpport)
+		if err != nil {
+			log.Printf("There appears to be an error with the UDP port specified. See error below.\n%v\n", err.Error())
+			return
+		}
+	}
+
+	//Setup SOCKS listener!
+	var socksAddr *net.TCPAddr
+	if opts.socksport != "" {
+		socksAddr, err = net.ResolveTCPAddr("tcp", opts.socksport)
+		if err != nil {
+			log.Printf("There appears to be an error with the SOCKS port specified. See error below.\n%v\n", err.Error())
+			return
+		}
+	}
+
+	//Setup HTTP CONNECT listener!
+	var connectAddr *net.TCPAddr
+	if opts.connectport != "" {
+		connectAddr, err = net.ResolveTCPAddr("tcp", opts.connectport)
+		if err != nil {
+			log.Printf("There appears to be an error with the HTTP CONNECT port specified. See error below.\n%v\n", err.Error())
+			return
+		}
+	}
+
+	//Setup forwarding listeners for ports that don't have a listener yet!
+	forwardAddrs := make(map[*net.TCPAddr]string)
+	for port, upstream := range opts.forward {
+		if port == opts.tcpport || port == opts.tlsport {
+			continue
+		}
+		forwardAddr, err := net.ResolveTCPAddr("tcp", port)
+		if err != nil {
+			log.Printf("There appears to be an error with the forwarding port specified. See error below.\n%v\n", err.Error())
+			return
+		}
+		forwardAddrs[forwardAddr] = upstream
+	}
+
+	//The TCP listeners only detect and terminate TLS if they have a TLS
+	//config. The TPROXY listener terminates TLS on every connection it is
+	//given a TLS config for, so it doesn't get one.
+	var detectConfig *tls.Config
+	if opts.detecttls {
+		detectConfig = tlsConfig
+	}
+	if opts.starttls {
+		pipe.StartTLSConfig = tlsConfig
+	}
 
 	//All good. Start listening.
-	tcpListener.Listen("tcp", tcpAddr, &tls.Config{})
+	if opts.tproxy {
+		tcpListener.Listen("tcp", tcpAddr, nil)
+	} else {
+		tcpListener.Listen("tcp", tcpAddr, detectConfig)
+	}
 	tlsListener.Listen("tcp", tlsAddr, tlsConfig)
 
 	log.Println("[INFO] Trudy lives!")
-	log.Printf("[INFO] Listening for TLS connections on port %s\n", tlsport)
-	log.Printf("[INFO] Listening for all other TCP connections on port %s\n", tcpport)
+	log.Printf("[INFO] Listening for TLS connections on port %s\n", opts.tlsport)
+	log.Printf("[INFO] Listening for all other TCP connections on port %s\n", opts.tcpport)
+
+	if udpAddr != nil {
+		udpListener := new(listener.UDPListener)
+		udpListener.Listen("udp", udpAddr, nil)
+		log.Printf("[INFO] Listening for UDP traffic on port %s\n", opts.udpport)
+		go connectionDispatcher(udpListener, "UDP", opts.show)
+	}
+
+	if socksAddr != nil {
+		socksListener := &listener.SOCKSListener{Username: opts.socksuser, Password: opts.sockspass}
+		socksListener.Listen("tcp", socksAddr, nil)
+		log.Printf("[INFO] Listening for SOCKS5 clients on port %s\n", opts.socksport)
+		go connectionDispatcher(socksListener, "SOCKS", opts.show)
+	}
+
+	if connectAddr != nil {
+		connectListener := new(listener.ConnectListener)
+		if opts.connecttls {
+			connectListener.Listen("tcp", connectAddr, tlsConfig)
+		} else {
+			connectListener.Listen("tcp", connectAddr, nil)
+		}
+		log.Printf("[INFO] Listening for HTTP CONNECT clients on port %s\n", opts.connectport)
+		go connectionDispatcher(connectListener, "CONNECT", opts.show)
+	}
+
+	for forwardAddr, upstream := range forwardAddrs {
+		forwardListener := &listener.TCPListener{Upstream: upstream, DetectTimeout: opts.detectwait}
+		forwardListener.Listen("tcp", forwardAddr, detectConfig)
+		log.Printf("[INFO] Forwarding TCP connections on port %v to %v\n", forwardAddr.Port, upstream)
+		go connectionDispatcher(forwardListener, "TCP", opts.show)
+	}
 
 	go websocketHandler()
-	go connectionDispatcher(tlsListener, "TLS", show)
-	connectionDispatcher(tcpListener, "TCP", show)
+	go connectionDispatcher(tlsListener, "TLS", opts.show)
+	connectionDispatcher(tcpListener, "TCP", opts.show)
 
 }
 
@@ -92,24 +487,149 @@ func connectionDispatcher(listener listener.TrudyListener, name string, show boo
 		if err != nil {
 			continue
 		}
+		id := uint(atomic.AddUint64(&connectionCount, 1) - 1)
+		//Opening a pipe can mean waiting for a TLS handshake and a dial,
+		//which must not hold up the next client.
+		go openPipe(id, fd, conn, name, show)
+	}
+}
 
-		p := new(pipe.TrudyPipe)
-		if name == "TLS" {
-			err = p.New(connectionCount, fd, conn, true)
-		} else {
-			err = p.New(connectionCount, fd, conn, false)
-		}
+//openPipe builds the pipe for a connection accepted by the listener called
+//name, fires the OnOpen hooks of its chain and runs it until it closes.
+func openPipe(id uint, fd int, conn net.Conn, name string, show bool) {
+	var p pipe.Pipe
+	if _, udp := conn.LocalAddr().(*net.UDPAddr); udp {
+		p = new(pipe.UDPPipe)
+	} else {
+		p = new(pipe.TrudyPipe)
+	}
+	_, useTLS := conn.(*tls.Conn)
+	opening := &openingPipe{name: name}
+	accepting.Store(id, opening)
+	err := p.New(id, fd, conn, useTLS)
+	accepting.Delete(id)
+	//The chain was chosen by beforeDial, unless the pipe failed before
+	//it could be dialed.
+	chain := opening.chain
+	if chain == nil {
+		chain = chainFor(name, p.Destination())
+	}
 
+	if err != nil {
+		log.Println("[ERR] Error creating new pipe.")
+		chain.OnError(p, err)
+		return
+	}
+	pipe.Pipes.Add(p)
+	if show {
+		log.Printf("[INFO] ( %v ) %v Connection accepted!\n", id, name)
+	}
+	if certs := clientCertificates(p); len(certs) > 0 {
+		saveClientCertificates(p, certs)
+	}
+	chain.OnOpen(p)
+	runPipe(p, chain, show)
+}
+
+//openingPipe is a pipe being opened by openPipe. chain is the chain chosen
+//for it by beforeDial, which runs in the same goroutine.
+type openingPipe struct {
+	name  string
+	chain module.Chain
+}
+
+//accepting maps the ids of pipes being opened to their openingPipe, for
+//beforeDial.
+var accepting sync.Map
+
+//beforeDial is the pipe.BeforeDial hook. It chooses the chain of modules the
+//pipe will use from the destination the client intended, and asks it where
+//to connect. A pipe keeps that chain even if it is redirected.
+func beforeDial(id uint, client net.Addr, destination string) (string, error) {
+	opening := &openingPipe{}
+	if o, ok := accepting.Load(id); ok {
+		opening = o.(*openingPipe)
+	}
+	opening.chain = chainFor(opening.name, destination)
+	return opening.chain.BeforeDial(id, client, destination)
+}
+
+//runPipe passes data through p in both directions until it closes, and fires
+//the OnError and OnClose hooks of chain when it does. Only the first error is
+//reported: once one direction fails, the other usually fails because the
+//pipe has been closed.
+func runPipe(p pipe.Pipe, chain module.Chain, show bool) {
+	var handlers sync.WaitGroup
+	var failure sync.Once
+	var reason error
+	done := func(err error) {
 		if err != nil {
-			log.Println("[ERR] Error creating new pipe.")
-			continue
-		}
-		if show {
-			log.Printf("[INFO] ( %v ) %v Connection accepted!\n", connectionCount, name)
+			failure.Do(func() {
+				reason = err
+				chain.OnError(p, err)
+			})
 		}
-		go clientHandler(p, show)
-		go serverHandler(p)
-		connectionCount++
+		handlers.Done()
+	}
+	handlers.Add(2)
+	go func() { done(clientHandler(p, chain)) }()
+	go func() { done(serverHandler(p, chain)) }()
+	handlers.Wait()
+	if show {
+		log.Printf("[INFO] ( %v ) Closing connection.\n", p.Id())
+	}
+	chain.OnClose(p, reason)
+}
+
+//chainFor returns the chain of modules for pipes to destination accepted by
+//the listener called name: the destination's chain if the config file gives
+//it one, else the listener's, else the one given with -modules. Only the most
+//specific destination entry is used, so its chain replaces that of "*".
+func chainFor(name string, destination string) module.Chain {
+	if chain, ok := destinationChains[pipe.LookupDestination(destination)]; ok {
+		return chain
+	}
+	if chain, ok := listenerChains[name]; ok {
+		return chain
+	}
+	return defaultChain
+}
+
+//connectionState returns the state of the TLS session on conn, or nil if conn
+//is not a TLS connection.
+func connectionState(conn net.Conn) *tls.ConnectionState {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		return &state
+	}
+	return nil
+}
+
+//clientCertificates returns the certificate chain the client of p presented
+//during the TLS handshake, if any.
+func clientCertificates(p pipe.Pipe) []*x509.Certificate {
+	if tlsConn, ok := p.ClientConn().(*tls.Conn); ok {
+		return tlsConn.ConnectionState().PeerCertificates
+	}
+	return nil
+}
+
+//saveClientCertificates logs the client certificate chain of p and, if
+//-clientcertdir is set, writes it to a PEM file named after the SHA-256
+//fingerprint of the leaf.
+func saveClientCertificates(p pipe.Pipe, certs []*x509.Certificate) {
+	log.Printf("[INFO] ( %v ) Client presented certificate %v\n", p.Id(), certs[0].Subject)
+	if clientCertDir == "" {
+		return
+	}
+	var chain []byte
+	for _, cert := range certs {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	fingerprint := sha256.Sum256(certs[0].Raw)
+	path := filepath.Join(clientCertDir, hex.EncodeToString(fingerprint[:])+".pem")
+	if err := os.WriteFile(path, chain, 0644); err != nil {
+		log.Printf("[ERR] ( %v ) Failed to save client certificate: %v\n", p.Id(), err)
 	}
 }
 
@@ -119,20 +639,21 @@ func errHandler(err error) {
 	}
 }
 
-//clientHandler manages data that is sent from the client to the server.
-func clientHandler(pipe pipe.Pipe, show bool) {
-	if show {
-		defer log.Printf("[INFO] ( %v ) Closing TCP connection.\n", pipe.Id())
-	}
-	defer pipe.Close()
-
+//clientHandler manages data that is sent from the client to the server. It
+//returns the error that ended the pipe, or nil once the client has finished
+//sending.
+func clientHandler(pipe pipe.Pipe, chain module.Chain) error {
 	buffer := make([]byte, 65535)
+	var sequence uint64
+	var offset int64
 
 	for {
 		bytesRead, clientReadErr := pipe.ReadFromClient(buffer)
+		readAt := time.Now()
 
 		if clientReadErr != io.EOF && clientReadErr != nil {
-			break
+			pipe.Close()
+			return clientReadErr
 		}
 
 		if clientReadErr != io.EOF && bytesRead == 0 {
@@ -140,23 +661,35 @@ func clientHandler(pipe pipe.Pipe, show bool) {
 		}
 
 		data := module.Data{FromClient: true,
-			Bytes:      buffer[:bytesRead],
-			TLSConfig:  tlsConfig,
-			ServerAddr: pipe.ServerInfo(),
-			ClientAddr: pipe.ClientInfo()}
+			Bytes:              buffer[:bytesRead],
+			TLSConfig:          tlsConfig,
+			ServerAddr:         pipe.ServerInfo(),
+			ClientAddr:         pipe.ClientInfo(),
+			Destination:        pipe.Destination(),
+			ClientCertificates: clientCertificates(pipe),
+			ClientTLS:          connectionState(pipe.ClientConn()),
+			ServerTLS:          connectionState(pipe.ServerConn()),
+			PipeID:             pipe.Id(),
+			Sequence:           sequence,
+			Offset:             offset,
+			Time:               readAt}
+		if data.ClientTLS != nil {
+			data.TLS = true
+			data.ServerName = data.ClientTLS.ServerName
+		}
+		sequence++
+		offset += int64(bytesRead)
 
-		data.Deserialize()
+		chain.Deserialize(&data, pipe)
 
-		if data.Drop() {
+		if chain.Drop(&data, pipe) {
 			continue
 		}
 
-		if data.DoMangle() {
-			data.Mangle()
-			bytesRead = len(data.Bytes)
-		}
+		chain.Mangle(&data, pipe)
+		bytesRead = len(data.Bytes)
 
-		if data.DoIntercept() {
+		if chain.DoIntercept(&data, pipe) {
 			if websocketConn == nil {
 				log.Printf("[ERR] Websocket Connection has not been setup yet! Cannot intercept.")
 				continue
@@ -185,35 +718,48 @@ func clientHandler(pipe pipe.Pipe, show bool) {
 			bytesRead = len(moddedBytes)
 		}
 
-		if data.DoPrint() {
-			log.Printf("%v -> %v\n%v\n", data.ClientAddr.String(), data.ServerAddr.String(), data.PrettyPrint())
+		if printing := chain.Printing(&data, pipe); len(printing) > 0 {
+			log.Printf("( %v ) %v -> %v #%v offset %v\n%v\n", data.PipeID, data.ClientAddr.String(), data.ServerAddr.String(),
+				data.Sequence, data.Offset, printing.PrettyPrint(&data, pipe))
 		}
 
-		data.Serialize()
+		chain.Serialize(&data, pipe)
 
-		data.BeforeWriteToServer(pipe)
+		chain.BeforeWriteToServer(&data, pipe)
 		bytesRead = len(data.Bytes)
 
 		_, serverWriteErr := pipe.WriteToServer(data.Bytes[:bytesRead])
-		if serverWriteErr != nil || clientReadErr == io.EOF {
-			break
+		if serverWriteErr != nil {
+			pipe.Close()
+			return serverWriteErr
+		}
+
+		//The client has finished sending, but may still be waiting for
+		//the server's reply.
+		if clientReadErr == io.EOF {
+			pipe.CloseWriteToServer()
+			return nil
 		}
 
-		data.AfterWriteToServer(pipe)
+		chain.AfterWriteToServer(&data, pipe)
 	}
 }
 
-//serverHandler manages data that is sent from the server to the client.
-func serverHandler(pipe pipe.Pipe) {
+//serverHandler manages data that is sent from the server to the client. It
+//returns the error that ended the pipe, or nil once the server has finished
+//sending.
+func serverHandler(pipe pipe.Pipe, chain module.Chain) error {
 	buffer := make([]byte, 65535)
-
-	defer pipe.Close()
+	var sequence uint64
+	var offset int64
 
 	for {
 		bytesRead, serverReadErr := pipe.ReadFromServer(buffer)
+		readAt := time.Now()
 
 		if serverReadErr != io.EOF && serverReadErr != nil {
-			break
+			pipe.Close()
+			return serverReadErr
 		}
 
 		if serverReadErr != io.EOF && bytesRead == 0 {
@@ -221,23 +767,35 @@ func serverHandler(pipe pipe.Pipe) {
 		}
 
 		data := module.Data{FromClient: false,
-			Bytes:      buffer[:bytesRead],
-			TLSConfig:  tlsConfig,
-			ClientAddr: pipe.ClientInfo(),
-			ServerAddr: pipe.ServerInfo()}
+			Bytes:              buffer[:bytesRead],
+			TLSConfig:          tlsConfig,
+			ClientAddr:         pipe.ClientInfo(),
+			ServerAddr:         pipe.ServerInfo(),
+			Destination:        pipe.Destination(),
+			ClientCertificates: clientCertificates(pipe),
+			ClientTLS:          connectionState(pipe.ClientConn()),
+			ServerTLS:          connectionState(pipe.ServerConn()),
+			PipeID:             pipe.Id(),
+			Sequence:           sequence,
+			Offset:             offset,
+			Time:               readAt}
+		if data.ClientTLS != nil {
+			data.TLS = true
+			data.ServerName = data.ClientTLS.ServerName
+		}
+		sequence++
+		offset += int64(bytesRead)
 
-		data.Deserialize()
+		chain.Deserialize(&data, pipe)
 
-		if data.Drop() {
+		if chain.Drop(&data, pipe) {
 			continue
 		}
 
-		if data.DoMangle() {
-			data.Mangle()
-			bytesRead = len(data.Bytes)
-		}
+		chain.Mangle(&data, pipe)
+		bytesRead = len(data.Bytes)
 
-		if data.DoIntercept() {
+		if chain.DoIntercept(&data, pipe) {
 			if websocketConn == nil {
 				log.Printf("[ERR] Websocket Connection has not been setup yet! Cannot intercept.")
 				continue
@@ -266,21 +824,28 @@ func serverHandler(pipe pipe.Pipe) {
 			bytesRead = len(moddedBytes)
 		}
 
-		if data.DoPrint() {
-			log.Printf("%v -> %v\n%v\n", data.ServerAddr.String(), data.ClientAddr.String(), data.PrettyPrint())
+		if printing := chain.Printing(&data, pipe); len(printing) > 0 {
+			log.Printf("( %v ) %v -> %v #%v offset %v\n%v\n", data.PipeID, data.ServerAddr.String(), data.ClientAddr.String(),
+				data.Sequence, data.Offset, printing.PrettyPrint(&data, pipe))
 		}
 
-		data.Serialize()
+		chain.Serialize(&data, pipe)
 
-		data.BeforeWriteToClient(pipe)
+		chain.BeforeWriteToClient(&data, pipe)
 		bytesRead = len(data.Bytes)
 
 		_, clientWriteErr := pipe.WriteToClient(data.Bytes[:bytesRead])
-		if clientWriteErr != nil || serverReadErr == io.EOF {
-			break
+		if clientWriteErr != nil {
+			pipe.Close()
+			return clientWriteErr
 		}
 
-		data.AfterWriteToClient(pipe)
+		if serverReadErr == io.EOF {
+			pipe.CloseWriteToClient()
+			return nil
+		}
+
+		chain.AfterWriteToClient(&data, pipe)
 	}
 }
 
@@ -298,12 +863,109 @@ func websocketHandler() {
 			return
 		}
 	})
+	http.HandleFunc("/pipes", listPipes)
+	http.HandleFunc("/pipes/", pipeHandler)
 	err := http.ListenAndServe(":8080", nil)
 	if err != nil {
 		panic(err)
 	}
 }
 
+//listPipes lists the open pipes as JSON.
+func listPipes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, pipe.Pipes.List())
+}
+
+//pipeHandler serves /pipes/<id>. GET describes the pipe as JSON and DELETE
+//closes it. A POST to /pipes/<id>/client or /pipes/<id>/server writes the
+//request body to that end of the pipe. /pipes/<id>/impair gets (GET) or
+//replaces (PUT) the pipe's impairments as JSON, and a POST of a JSON fault to
+///pipes/<id>/fault injects it.
+func pipeHandler(w http.ResponseWriter, r *http.Request) {
+	path, end, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/pipes/"), "/")
+	id, err := strconv.ParseUint(path, 10, 0)
+	if err != nil {
+		http.Error(w, "invalid pipe id", http.StatusBadRequest)
+		return
+	}
+	p, ok := pipe.Pipes.Get(uint(id))
+	if !ok {
+		http.Error(w, "no such pipe", http.StatusNotFound)
+		return
+	}
+	switch {
+	case end == "" && r.Method == http.MethodGet:
+		writeJSON(w, pipe.Info(p))
+	case end == "" && r.Method == http.MethodDelete:
+		pipe.Pipes.Kill(uint(id))
+		log.Printf("[INFO] ( %v ) Closed from the web API.\n", id)
+		w.WriteHeader(http.StatusNoContent)
+	case end == "impair" && r.Method == http.MethodGet:
+		writeJSON(w, pipe.Info(p).Impairments)
+	case end == "impair" && r.Method == http.MethodPut:
+		var impairments pipe.Impairments
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&impairments); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := pipe.Pipes.Impair(uint(id), impairments); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Printf("[INFO] ( %v ) Impairments changed from the web API.\n", id)
+		w.WriteHeader(http.StatusNoContent)
+	case end == "fault" && r.Method == http.MethodPost:
+		var fault pipe.Fault
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&fault); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := pipe.Pipes.Fault(uint(id), fault); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case (end == "client" || end == "server") && r.Method == http.MethodPost:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var n int
+		if end == "client" {
+			n, err = pipe.Pipes.InjectToClient(uint(id), data)
+		} else {
+			n, err = pipe.Pipes.InjectToServer(uint(id), data)
+		}
+		if err != nil {
+			log.Printf("[ERR] ( %v ) Failed to inject data into the %v end: %v\n", id, end, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		log.Printf("[INFO] ( %v ) Injected %v bytes into the %v end.\n", id, n, end)
+		w.WriteHeader(http.StatusNoContent)
+	case end == "" || end == "client" || end == "server" || end == "impair" || end == "fault":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[ERR] Failed to write JSON response: %v\n", err)
+	}
+}
+
 const editor string = `<!-- this wonderful page was found here: https://github.com/xem/hex -->
 <body onload='
 // Reset the textarea value
@@ -332,8 +994,36 @@ for(i=0;i<16;i++)
         document.getElementById('m').value = "00"
         document.getElementById('m').oninput()
     }
+    var injectFault = function() {
+        var fault = {action: document.getElementById('faultaction').value,
+                     to: document.getElementById('faultto').value}
+        var numbers = ['bytes', 'bits', 'chunks']
+        for (var i = 0; i < numbers.length; i++) {
+            var value = document.getElementById('fault' + numbers[i]).value
+            if (value != "") fault[numbers[i]] = parseInt(value)
+        }
+        var duration = document.getElementById('faultduration').value
+        if (duration != "") fault.duration = duration
+        var result = document.getElementById('faultresult')
+        var url = "/pipes/" + document.getElementById('faultpipe').value + "/fault"
+        fetch(url, {method: "POST", body: JSON.stringify(fault)}).then(function (response) {
+            return response.text().then(function (text) {
+                result.textContent = response.ok ? " injected" : " " + text
+            })
+        })
+    }
 </script>
 <button onclick="sender()" id='send' disabled=true>send</button>
+<p>
+pipe <input id='faultpipe' type=number min=0 size=6>
+<select id='faultaction'><option>reset<option>truncate<option>stall<option>corrupt</select>
+toward the <select id='faultto'><option>client<option>server</select>
+bytes <input id='faultbytes' type=number min=0 size=6>
+duration <input id='faultduration' size=6 placeholder='2s'>
+bits <input id='faultbits' type=number min=0 size=4>
+chunks <input id='faultchunks' type=number min=0 size=4>
+<button onclick="injectFault()">inject fault</button><span id='faultresult'></span>
+</p>
 <!-- END TRUDY SPECIFIC CODE -->
 </body>
 <table border><td><pre><td id=t><tr><td id=l width=80>00000000<td><textarea spellcheck=false id=m oninput='
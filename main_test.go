@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/tls"
+	"github.com/praetorian-inc/trudy/listener"
+	"github.com/praetorian-inc/trudy/module"
+	"github.com/praetorian-inc/trudy/pipe"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+//fakeListener hands out connections forwarded to upstream, then blocks.
+type fakeListener struct {
+	conns    chan net.Conn
+	upstream string
+}
+
+func (fl *fakeListener) Listen(string, net.Addr, *tls.Config) {}
+
+func (fl *fakeListener) Accept() (int, net.Conn, error) {
+	return -1, &listener.ForwardConn{Conn: <-fl.conns, Upstream: fl.upstream}, nil
+}
+
+func (fl *fakeListener) Close() error { return nil }
+
+func TestConcurrentDispatchers(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	var servers []net.Conn
+	var serversMutex sync.Mutex
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			serversMutex.Lock()
+			servers = append(servers, conn)
+			serversMutex.Unlock()
+		}
+	}()
+
+	const dispatchers, perDispatcher = 8, 25
+	var clients []net.Conn
+	for i := 0; i < dispatchers; i++ {
+		fl := &fakeListener{conns: make(chan net.Conn, perDispatcher), upstream: upstream.Addr().String()}
+		for j := 0; j < perDispatcher; j++ {
+			client, trudy := net.Pipe()
+			clients = append(clients, client)
+			fl.conns <- trudy
+		}
+		go connectionDispatcher(fl, "TCP", false)
+	}
+
+	//Pipes are registered by id, so colliding ids would leave fewer of
+	//them registered than were opened.
+	var open []pipe.PipeInfo
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if open = pipe.Pipes.List(); len(open) == dispatchers*perDispatcher {
+			break
+		}
+	}
+	if len(open) != dispatchers*perDispatcher {
+		t.Errorf("%v pipes are registered, want %v", len(open), dispatchers*perDispatcher)
+	}
+	for _, info := range open {
+		pipe.Pipes.Kill(info.Id)
+	}
+	for _, client := range clients {
+		client.Close()
+	}
+	serversMutex.Lock()
+	for _, server := range servers {
+		server.Close()
+	}
+	serversMutex.Unlock()
+}
+
+func TestLoadConfigListeners(t *testing.T) {
+	tests := []struct {
+		config string
+		err    bool
+	}{
+		{config: `{"listeners": {"TLS": {"modules": ["default"]}}}`},
+		{config: `{"listeners": {"socks": {"modules": []}}}`},
+		{config: `{"listeners": {"HTTP": {"modules": ["default"]}}}`, err: true},
+		{config: `{"listeners": {"TCP": {"modules": ["nosuchmodule"]}}}`, err: true},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(test.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadConfig(path); (err != nil) != test.err {
+			t.Errorf("%v: got %v", test.config, err)
+		}
+	}
+}
+
+//redirector is a module that sends every connection to to and reports the
+//pipes it is used for on opened.
+type redirector struct {
+	module.Base
+	to     string
+	opened chan uint
+}
+
+func (r redirector) BeforeDial(id uint, client net.Addr, destination string) (string, error) {
+	return r.to, nil
+}
+
+func (r redirector) OnOpen(p pipe.Pipe) {
+	r.opened <- p.Id()
+}
+
+func TestChainKeptAfterRedirect(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		if conn, err := upstream.Accept(); err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	//The destination the pipe is redirected to has a chain of its own.
+	redirectedTo := &pipe.DestinationConfig{Modules: []string{}}
+	if err := pipe.Configure(map[string]*pipe.DestinationConfig{upstream.Addr().String(): redirectedTo}); err != nil {
+		t.Fatal(err)
+	}
+	defer pipe.Configure(nil)
+	viaOriginal, viaRedirect := make(chan uint, 1), make(chan uint, 1)
+	savedChain, savedHook := defaultChain, pipe.BeforeDial
+	pipe.BeforeDial = beforeDial
+	defaultChain = module.Chain{redirector{to: upstream.Addr().String(), opened: viaOriginal}}
+	destinationChains[redirectedTo] = module.Chain{redirector{to: "127.0.0.1:1", opened: viaRedirect}}
+	defer func() {
+		defaultChain, pipe.BeforeDial = savedChain, savedHook
+		delete(destinationChains, redirectedTo)
+	}()
+
+	client, trudy := net.Pipe()
+	defer client.Close()
+	const id = 1 << 20
+	go openPipe(id, -1, &listener.ForwardConn{Conn: trudy, Upstream: "127.0.0.1:1"}, "TCP", false)
+	select {
+	case <-viaOriginal:
+	case <-viaRedirect:
+		t.Error("the pipe switched to the chain of the destination it was redirected to")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the pipe wasn't opened")
+	}
+	pipe.Pipes.Kill(id)
+}
+
+//TestChainForReplacesWildcard checks that a destination's own modules replace
+//those of "*" rather than adding to them.
+func TestChainForReplacesWildcard(t *testing.T) {
+	savedChains, savedListeners := destinationChains, listenerChains
+	destinationChains = make(map[*pipe.DestinationConfig]module.Chain)
+	listenerChains = make(map[string]module.Chain)
+	defer func() {
+		destinationChains, listenerChains = savedChains, savedListeners
+		pipe.Configure(nil)
+	}()
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{"destinations": {
+		"*": {"modules": ["default"]},
+		"10.0.0.5:1883": {"modules": []},
+		"10.0.0.6": {"timeouts": {"read": "1m"}}}}`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		destination string
+		want        int
+	}{
+		{"10.0.0.5:1883", 0},
+		{"10.0.0.7:80", 1},
+		//An entry without modules has no chain of its own, but it is
+		//still the entry that matches, so "*" doesn't apply either.
+		{"10.0.0.6:80", len(defaultChain)},
+	}
+	for _, test := range tests {
+		if got := len(chainFor("TCP", test.destination)); got != test.want {
+			t.Errorf("%v: got %v modules, want %v", test.destination, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package module
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/praetorian-inc/trudy/pipe"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//Module is a stage of the chain every chunk of data passes through. Its
+//per-chunk methods are those of Data, taking the Data as left by the previous
+//module in the chain. Its lifecycle hooks are called for every pipe the chain
+//is used for. Modules are shared by every pipe, so they must be safe for use
+//in multiple goroutines; per-pipe state belongs in the pipe's context (see
+//pipe.Pipe.AddContext).
+type Module interface {
+	//BeforeDial is called before the server is dialed for the pipe with the
+	//given id. It returns the destination to dial, which is usually
+	//destination itself, or an error to refuse the connection. See
+	//pipe.BeforeDial.
+	BeforeDial(id uint, client net.Addr, destination string) (string, error)
+
+	//OnOpen is called once a pipe has been opened, before any data flows.
+	OnOpen(p pipe.Pipe)
+
+	//OnError is called with the error that kept a pipe from opening or
+	//ended it. If the pipe failed to open, only its Id, Destination and
+	//ClientInfo are known.
+	OnError(p pipe.Pipe, err error)
+
+	//OnClose is called once both directions of an open pipe have finished.
+	//reason is the error that ended the pipe, or nil if both ends finished
+	//sending.
+	OnClose(p pipe.Pipe, reason error)
+
+	Deserialize(data *Data, p pipe.Pipe)
+	Drop(data *Data, p pipe.Pipe) bool
+	DoMangle(data *Data, p pipe.Pipe) bool
+	Mangle(data *Data, p pipe.Pipe)
+	DoIntercept(data *Data, p pipe.Pipe) bool
+	DoPrint(data *Data, p pipe.Pipe) bool
+	PrettyPrint(data *Data, p pipe.Pipe) string
+	Serialize(data *Data, p pipe.Pipe)
+	BeforeWriteToClient(data *Data, p pipe.Pipe)
+	AfterWriteToClient(data *Data, p pipe.Pipe)
+	BeforeWriteToServer(data *Data, p pipe.Pipe)
+	AfterWriteToServer(data *Data, p pipe.Pipe)
+}
+
+//Base implements every Module method as a no-op that leaves data alone. Embed
+//it in a module and override only the methods the module needs.
+type Base struct{}
+
+func (Base) Deserialize(data *Data, p pipe.Pipe)         {}
+func (Base) Drop(data *Data, p pipe.Pipe) bool           { return false }
+func (Base) DoMangle(data *Data, p pipe.Pipe) bool       { return false }
+func (Base) Mangle(data *Data, p pipe.Pipe)              {}
+func (Base) DoIntercept(data *Data, p pipe.Pipe) bool    { return false }
+func (Base) DoPrint(data *Data, p pipe.Pipe) bool        { return false }
+func (Base) PrettyPrint(data *Data, p pipe.Pipe) string  { return hex.Dump(data.Bytes) }
+func (Base) Serialize(data *Data, p pipe.Pipe)           {}
+func (Base) BeforeWriteToClient(data *Data, p pipe.Pipe) {}
+func (Base) AfterWriteToClient(data *Data, p pipe.Pipe)  {}
+func (Base) BeforeWriteToServer(data *Data, p pipe.Pipe) {}
+func (Base) AfterWriteToServer(data *Data, p pipe.Pipe)  {}
+
+func (Base) BeforeDial(id uint, client net.Addr, destination string) (string, error) {
+	return destination, nil
+}
+func (Base) OnOpen(p pipe.Pipe)                {}
+func (Base) OnError(p pipe.Pipe, err error)    {}
+func (Base) OnClose(p pipe.Pipe, reason error) {}
+
+//Default is the module registered as "default". It calls the methods of Data
+//in module.go, so Trudy behaves as it always has when it is the only module.
+//Its lifecycle hooks do nothing.
+type Default struct{ Base }
+
+func (Default) Deserialize(data *Data, p pipe.Pipe)         { data.Deserialize(p) }
+func (Default) Drop(data *Data, p pipe.Pipe) bool           { return data.Drop(p) }
+func (Default) DoMangle(data *Data, p pipe.Pipe) bool       { return data.DoMangle(p) }
+func (Default) Mangle(data *Data, p pipe.Pipe)              { data.Mangle(p) }
+func (Default) DoIntercept(data *Data, p pipe.Pipe) bool    { return data.DoIntercept(p) }
+func (Default) DoPrint(data *Data, p pipe.Pipe) bool        { return data.DoPrint(p) }
+func (Default) PrettyPrint(data *Data, p pipe.Pipe) string  { return data.PrettyPrint(p) }
+func (Default) Serialize(data *Data, p pipe.Pipe)           { data.Serialize(p) }
+func (Default) BeforeWriteToClient(data *Data, p pipe.Pipe) { data.BeforeWriteToClient(p) }
+func (Default) AfterWriteToClient(data *Data, p pipe.Pipe)  { data.AfterWriteToClient(p) }
+func (Default) BeforeWriteToServer(data *Data, p pipe.Pipe) { data.BeforeWriteToServer(p) }
+func (Default) AfterWriteToServer(data *Data, p pipe.Pipe)  { data.AfterWriteToServer(p) }
+
+var registry = struct {
+	sync.Mutex
+	modules map[string]Module
+}{modules: map[string]Module{"default": Default{}}}
+
+//Register makes m available under name, for use in chains. Modules usually
+//register themselves from an init function in their own file in this
+//package. Register panics if name is already taken.
+func Register(name string, m Module) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.modules[name]; ok {
+		panic("module: " + name + " is registered twice")
+	}
+	registry.modules[name] = m
+}
+
+//Names returns the names of the registered modules.
+func Names() []string {
+	registry.Lock()
+	defer registry.Unlock()
+	var names []string
+	for name := range registry.modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//Chain is an ordered list of modules. Data passes through the modules in
+//order, except for Serialize, which runs in reverse order so each module
+//undoes its own Deserialize in turn.
+type Chain []Module
+
+//NewChain returns the chain of the modules registered under names, in order.
+func NewChain(names []string) (Chain, error) {
+	chain := Chain{}
+	for _, name := range names {
+		registry.Lock()
+		m, ok := registry.modules[name]
+		registry.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown module %q (available: %v)", name, strings.Join(Names(), ", "))
+		}
+		chain = append(chain, m)
+	}
+	return chain, nil
+}
+
+//ParseChain returns the chain of the comma-separated module names in list.
+//"" and "none" make an empty chain, which passes data through untouched.
+func ParseChain(list string) (Chain, error) {
+	if list == "" || list == "none" {
+		return Chain{}, nil
+	}
+	return NewChain(strings.Split(list, ","))
+}
+
+//Deserialize calls Deserialize on every module.
+func (c Chain) Deserialize(data *Data, p pipe.Pipe) {
+	for _, m := range c {
+		m.Deserialize(data, p)
+	}
+}
+
+//Drop reports whether any module drops data. Modules after the first to
+//drop it are not asked.
+func (c Chain) Drop(data *Data, p pipe.Pipe) bool {
+	for _, m := range c {
+		if m.Drop(data, p) {
+			return true
+		}
+	}
+	return false
+}
+
+//Mangle calls Mangle on every module whose DoMangle returns true.
+func (c Chain) Mangle(data *Data, p pipe.Pipe) {
+	for _, m := range c {
+		if m.DoMangle(data, p) {
+			m.Mangle(data, p)
+		}
+	}
+}
+
+//DoIntercept reports whether any module wants data sent to the interceptor.
+func (c Chain) DoIntercept(data *Data, p pipe.Pipe) bool {
+	for _, m := range c {
+		if m.DoIntercept(data, p) {
+			return true
+		}
+	}
+	return false
+}
+
+//DoPrint reports whether any module wants data printed.
+func (c Chain) DoPrint(data *Data, p pipe.Pipe) bool {
+	for _, m := range c {
+		if m.DoPrint(data, p) {
+			return true
+		}
+	}
+	return false
+}
+
+//Printing returns the chain of the modules whose DoPrint returns true, so
+//DoPrint is asked only once per module.
+func (c Chain) Printing(data *Data, p pipe.Pipe) Chain {
+	printing := Chain{}
+	for _, m := range c {
+		if m.DoPrint(data, p) {
+			printing = append(printing, m)
+		}
+	}
+	return printing
+}
+
+//PrettyPrint joins the PrettyPrint output of every module. Use Printing to
+//print only the modules that want data printed.
+func (c Chain) PrettyPrint(data *Data, p pipe.Pipe) string {
+	var printed []string
+	for _, m := range c {
+		printed = append(printed, m.PrettyPrint(data, p))
+	}
+	return strings.Join(printed, "\n")
+}
+
+//Serialize calls Serialize on every module, last module first.
+func (c Chain) Serialize(data *Data, p pipe.Pipe) {
+	for i := len(c) - 1; i >= 0; i-- {
+		c[i].Serialize(data, p)
+	}
+}
+
+//BeforeWriteToClient calls BeforeWriteToClient on every module.
+func (c Chain) BeforeWriteToClient(data *Data, p pipe.Pipe) {
+	for _, m := range c {
+		m.BeforeWriteToClient(data, p)
+	}
+}
+
+//AfterWriteToClient calls AfterWriteToClient on every module.
+func (c Chain) AfterWriteToClient(data *Data, p pipe.Pipe) {
+	for _, m := range c {
+		m.AfterWriteToClient(data, p)
+	}
+}
+
+//BeforeWriteToServer calls BeforeWriteToServer on every module.
+func (c Chain) BeforeWriteToServer(data *Data, p pipe.Pipe) {
+	for _, m := range c {
+		m.BeforeWriteToServer(data, p)
+	}
+}
+
+//AfterWriteToServer calls AfterWriteToServer on every module.
+func (c Chain) AfterWriteToServer(data *Data, p pipe.Pipe) {
+	for _, m := range c {
+		m.AfterWriteToServer(data, p)
+	}
+}
+
+//BeforeDial asks every module for the destination to dial in turn, each
+//getting the destination chosen by the previous one. The first error refuses
+//the connection.
+func (c Chain) BeforeDial(id uint, client net.Addr, destination string) (string, error) {
+	for _, m := range c {
+		var err error
+		if destination, err = m.BeforeDial(id, client, destination); err != nil {
+			return "", err
+		}
+	}
+	return destination, nil
+}
+
+//OnOpen calls OnOpen on every module.
+func (c Chain) OnOpen(p pipe.Pipe) {
+	for _, m := range c {
+		m.OnOpen(p)
+	}
+}
+
+//OnError calls OnError on every module.
+func (c Chain) OnError(p pipe.Pipe, err error) {
+	for _, m := range c {
+		m.OnError(p, err)
+	}
+}
+
+//OnClose calls OnClose on every module.
+func (c Chain) OnClose(p pipe.Pipe, reason error) {
+	for _, m := range c {
+		m.OnClose(p, reason)
+	}
+}
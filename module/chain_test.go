@@ -0,0 +1,199 @@
+package module
+
+import (
+	"errors"
+	"github.com/praetorian-inc/trudy/pipe"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//recorder is a module that records the calls made to it in calls.
+type recorder struct {
+	Base
+	name   string
+	calls  *[]string
+	drop   bool
+	mangle bool
+	print  bool
+}
+
+func (r recorder) record(method string) {
+	*r.calls = append(*r.calls, r.name+"."+method)
+}
+
+func (r recorder) Deserialize(data *Data, p pipe.Pipe) { r.record("Deserialize") }
+func (r recorder) Serialize(data *Data, p pipe.Pipe)   { r.record("Serialize") }
+func (r recorder) Mangle(data *Data, p pipe.Pipe)      { r.record("Mangle") }
+
+func (r recorder) Drop(data *Data, p pipe.Pipe) bool {
+	r.record("Drop")
+	return r.drop
+}
+
+func (r recorder) DoMangle(data *Data, p pipe.Pipe) bool {
+	r.record("DoMangle")
+	return r.mangle
+}
+
+func (r recorder) DoPrint(data *Data, p pipe.Pipe) bool {
+	r.record("DoPrint")
+	return r.print
+}
+
+func (r recorder) PrettyPrint(data *Data, p pipe.Pipe) string {
+	r.record("PrettyPrint")
+	return r.name
+}
+
+func (r recorder) BeforeDial(id uint, client net.Addr, destination string) (string, error) {
+	r.record("BeforeDial")
+	if r.drop {
+		return "", errors.New(r.name + " refused")
+	}
+	return destination + "/" + r.name, nil
+}
+
+//recorders returns a chain of recorders named a, b, c... sharing calls.
+//configure sets up each recorder by its position.
+func recorders(n int, calls *[]string, configure func(i int, r *recorder)) Chain {
+	chain := Chain{}
+	for i := 0; i < n; i++ {
+		r := recorder{name: string(rune('a' + i)), calls: calls}
+		if configure != nil {
+			configure(i, &r)
+		}
+		chain = append(chain, r)
+	}
+	return chain
+}
+
+func TestChainOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		call func(c Chain)
+		want []string
+	}{
+		{name: "Deserialize runs in order",
+			call: func(c Chain) { c.Deserialize(&Data{}, nil) },
+			want: []string{"a.Deserialize", "b.Deserialize", "c.Deserialize"}},
+		{name: "Serialize runs in reverse",
+			call: func(c Chain) { c.Serialize(&Data{}, nil) },
+			want: []string{"c.Serialize", "b.Serialize", "a.Serialize"}},
+		{name: "Mangle runs for modules that want to mangle",
+			call: func(c Chain) { c.Mangle(&Data{}, nil) },
+			want: []string{"a.DoMangle", "b.DoMangle", "b.Mangle", "c.DoMangle"}},
+	}
+	for _, test := range tests {
+		var calls []string
+		test.call(recorders(3, &calls, func(i int, r *recorder) { r.mangle = i == 1 }))
+		if !reflect.DeepEqual(calls, test.want) {
+			t.Errorf("%v: got %v, want %v", test.name, calls, test.want)
+		}
+	}
+}
+
+func TestChainDrop(t *testing.T) {
+	tests := []struct {
+		name  string
+		drops []bool
+		want  bool
+		asked []string
+	}{
+		{name: "empty chain", drops: nil, want: false, asked: nil},
+		{name: "nobody drops", drops: []bool{false, false, false}, want: false,
+			asked: []string{"a.Drop", "b.Drop", "c.Drop"}},
+		{name: "first drops", drops: []bool{true, false, false}, want: true,
+			asked: []string{"a.Drop"}},
+		{name: "middle drops", drops: []bool{false, true, true}, want: true,
+			asked: []string{"a.Drop", "b.Drop"}},
+		{name: "last drops", drops: []bool{false, false, true}, want: true,
+			asked: []string{"a.Drop", "b.Drop", "c.Drop"}},
+	}
+	for _, test := range tests {
+		var calls []string
+		chain := recorders(len(test.drops), &calls, func(i int, r *recorder) { r.drop = test.drops[i] })
+		if got := chain.Drop(&Data{}, nil); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+		}
+		if !reflect.DeepEqual(calls, test.asked) {
+			t.Errorf("%v: asked %v, want %v", test.name, calls, test.asked)
+		}
+	}
+}
+
+func TestChainPrinting(t *testing.T) {
+	var calls []string
+	chain := recorders(3, &calls, func(i int, r *recorder) { r.print = i != 1 })
+	printing := chain.Printing(&Data{}, nil)
+	if got := printing.PrettyPrint(&Data{}, nil); got != "a\nc" {
+		t.Errorf("got %q, want %q", got, "a\nc")
+	}
+	want := []string{"a.DoPrint", "b.DoPrint", "c.DoPrint", "a.PrettyPrint", "c.PrettyPrint"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("got %v, want %v", calls, want)
+	}
+}
+
+func TestChainBeforeDial(t *testing.T) {
+	var calls []string
+	dest, err := recorders(3, &calls, nil).BeforeDial(0, nil, "example.com:80")
+	if err != nil || dest != "example.com:80/a/b/c" {
+		t.Errorf("got %q, %v", dest, err)
+	}
+
+	calls = nil
+	chain := recorders(3, &calls, func(i int, r *recorder) { r.drop = i == 1 })
+	if _, err = chain.BeforeDial(0, nil, "example.com:80"); err == nil {
+		t.Error("a refused connection was dialed")
+	}
+	if want := []string{"a.BeforeDial", "b.BeforeDial"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("asked %v, want %v", calls, want)
+	}
+}
+
+func TestParseChain(t *testing.T) {
+	var calls []string
+	Register("chaintest-first", recorder{name: "first", calls: &calls})
+	Register("chaintest-second", recorder{name: "second", calls: &calls})
+
+	tests := []struct {
+		list string
+		want []string
+		err  bool
+	}{
+		{list: "", want: nil},
+		{list: "none", want: nil},
+		{list: "chaintest-first", want: []string{"first"}},
+		{list: "chaintest-second,chaintest-first", want: []string{"second", "first"}},
+		{list: "chaintest-first,nosuchmodule", err: true},
+		{list: "chaintest-first,", err: true},
+		{list: "None", err: true},
+	}
+	for _, test := range tests {
+		chain, err := ParseChain(test.list)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: got %v modules, want an error", test.list, len(chain))
+			} else if !strings.Contains(err.Error(), "chaintest-first") {
+				t.Errorf("%q: %v doesn't list the available modules", test.list, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.list, err)
+			continue
+		}
+		if chain == nil {
+			t.Errorf("%q: got a nil chain", test.list)
+		}
+		var names []string
+		for _, m := range chain {
+			names = append(names, m.(recorder).name)
+		}
+		if !reflect.DeepEqual(names, test.want) {
+			t.Errorf("%q: got %v, want %v", test.list, names, test.want)
+		}
+	}
+}
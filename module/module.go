@@ -2,63 +2,78 @@ package module
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"github.com/praetorian-inc/trudy/pipe"
 	"net"
+	"time"
 )
 
 //Data is a thin wrapper that provides metadata that may be useful when mangling bytes on the network.
+//Every method of Data is passed the pipe the data is passing through. Its
+//context (see pipe.Pipe.AddContext) can hold per-connection state, such as a
+//session key negotiated earlier, to base every decision on.
 type Data struct {
-	FromClient bool        //FromClient is true is the data sent is coming from the client (the device you are proxying)
-	Bytes      []byte      //Bytes is a byte slice that contians the TCP data
-	TLSConfig  *tls.Config //TLSConfig is a TLS server config that contains Trudy's TLS server certficiate.
-	ServerAddr net.Addr    //ServerAddr is net.Addr of the server
-	ClientAddr net.Addr    //ClientAddr is the net.Addr of the client (the device you are proxying)
+	FromClient         bool                 //FromClient is true is the data sent is coming from the client (the device you are proxying)
+	Bytes              []byte               //Bytes is a byte slice that contians the TCP data
+	TLSConfig          *tls.Config          //TLSConfig is a TLS server config that contains Trudy's TLS server certficiate.
+	ServerAddr         net.Addr             //ServerAddr is net.Addr of the server
+	ClientAddr         net.Addr             //ClientAddr is the net.Addr of the client (the device you are proxying)
+	Destination        string               //Destination is the "host:port" the client asked for. The host may be a hostname (e.g. from a SOCKS or HTTP CONNECT request).
+	ClientCertificates []*x509.Certificate  //ClientCertificates is the certificate chain the client presented during the TLS handshake, if any. The leaf comes first.
+	ClientTLS          *tls.ConnectionState //ClientTLS describes the TLS session with the client (negotiated protocol, version, cipher suite, ...). It is nil if the client end is not TLS.
+	ServerTLS          *tls.ConnectionState //ServerTLS describes the TLS session with the server. It is nil if the server end is not TLS.
+	PipeID             uint                 //PipeID is the Id of the pipe the data is passing through.
+	Sequence           uint64               //Sequence numbers the chunks read in this direction of the pipe, starting at 0.
+	Offset             int64                //Offset is the position of the chunk's first byte in this direction's stream, counting bytes as they were read (before any module changed them).
+	Time               time.Time            //Time is when the chunk was read.
+	TLS                bool                 //TLS is true if the client end of the pipe is TLS (a TLS listener, detected TLS or a STARTTLS upgrade).
+	ServerName         string               //ServerName is the server name (SNI) the client asked for in its TLS handshake, if any.
 }
 
 //DoMangle will return true if Data needs to be sent to the Mangle function.
-func (input Data) DoMangle() bool {
+func (input Data) DoMangle(p pipe.Pipe) bool {
 	return true
 }
 
 //Mangle can modify/replace the Bytes values within the Data struct. This can
 //be empty if no programmatic mangling needs to be done.
-func (input *Data) Mangle() {
+func (input *Data) Mangle(p pipe.Pipe) {
 
 }
 
 //Drop will return true if the Data needs to be dropped before going through
 //the pipe.
-func (input Data) Drop() bool {
+func (input Data) Drop(p pipe.Pipe) bool {
 	return false
 }
 
 //PrettyPrint returns the string representation of the data. This string will
 //be the value that is logged to the console.
-func (input Data) PrettyPrint() string {
+func (input Data) PrettyPrint(p pipe.Pipe) string {
 	return hex.Dump(input.Bytes)
 }
 
 //DoPrint will return true if the PrettyPrinted version of the Data struct
 //needs to be logged to the console.
-func (input Data) DoPrint() bool {
+func (input Data) DoPrint(p pipe.Pipe) bool {
 	return true
 }
 
 //DoIntercept returns true if data should be sent to the Trudy interceptor.
-func (input Data) DoIntercept() bool {
+func (input Data) DoIntercept(p pipe.Pipe) bool {
 	return false
 }
 
 //Deserialize should replace the Data struct's Bytes with a deserialized bytes.
 //For example, unpacking a HTTP/2 frame would be deserialization.
-func (input *Data) Deserialize() {
+func (input *Data) Deserialize(p pipe.Pipe) {
 
 }
 
 //Serialize should replace the Data struct's Bytes with the serialized form of
 //the bytes. The serialized bytes will be sent over the wire.
-func (input *Data) Serialize() {
+func (input *Data) Serialize(p pipe.Pipe) {
 
 }
 
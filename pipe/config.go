@@ -0,0 +1,262 @@
+package pipe
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+//DestinationConfig holds the settings for pipes to a particular destination.
+type DestinationConfig struct {
+	//TLS configures TLS connections to the server.
+	TLS *ServerTLS `json:"tls"`
+
+	//Passthrough makes Trudy pass TLS connections through untouched
+	//instead of intercepting them. Destinations are also matched against
+	//the SNI of the client's ClientHello.
+	Passthrough bool `json:"passthrough"`
+
+	//Timeouts overrides the default timeouts of pipes to the destination.
+	Timeouts *TimeoutsConfig `json:"timeouts"`
+
+	//Impair degrades pipes to the destination instead of the default
+	//impairments.
+	Impair *Impairments `json:"impair"`
+
+	//Faults injects faults into pipes to the destination when the data
+	//sent through them matches.
+	Faults []*FaultRule `json:"faults"`
+
+	//Modules names the modules, in order, that data of pipes to the
+	//destination passes through, instead of the listener's. An empty list
+	//passes data through untouched.
+	Modules []string `json:"modules"`
+}
+
+//ServerTLS configures the TLS connections Trudy makes to a server. By default
+//the server's certificate is not verified.
+type ServerTLS struct {
+	//CA is the path to a PEM bundle. If set, the server's certificate must
+	//chain to one of its certificates and match the server name.
+	CA string `json:"ca"`
+
+	//Pins is a list of base64 encoded SHA-256 hashes of
+	//SubjectPublicKeyInfos. If set, one of the certificates presented by the
+	//server must have one of these keys.
+	Pins []string `json:"pins"`
+
+	//Cert and Key are the paths to a PEM client certificate and key to
+	//present to servers that ask for one.
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+
+	//MinVersion and MaxVersion limit the TLS versions offered to the server
+	//("1.0", "1.1", "1.2" or "1.3").
+	MinVersion string `json:"minversion"`
+	MaxVersion string `json:"maxversion"`
+
+	//Ciphers lists the names of the cipher suites offered to the server
+	//(e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"). TLS 1.3 cipher suites
+	//are not configurable.
+	Ciphers []string `json:"ciphers"`
+
+	//ServerName overrides the server name sent with SNI and used to verify
+	//the server's certificate.
+	ServerName string `json:"servername"`
+
+	config *tls.Config
+}
+
+//DeviceConfig holds the settings for pipes from a particular client device.
+type DeviceConfig struct {
+	//Cert and Key are the paths to a PEM client certificate and key that
+	//are presented on the device's behalf to servers that ask for a client
+	//certificate. They take precedence over the ServerTLS certificate.
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+
+	certificate tls.Certificate
+}
+
+//destinationConfigs holds the DestinationConfigs installed by Configure.
+var destinationConfigs map[string]*DestinationConfig
+
+//deviceConfigs holds the DeviceConfigs installed by ConfigureDevices.
+var deviceConfigs map[string]*DeviceConfig
+
+//Configure installs per-destination settings. Settings are keyed by
+//"host:port", "host", ":port" or "*", which are tried in that order when a pipe
+//is created, so the most specific key wins.
+func Configure(configs map[string]*DestinationConfig) error {
+	for dest, config := range configs {
+		if config.TLS != nil {
+			if err := config.TLS.load(); err != nil {
+				return fmt.Errorf("%v: %v", dest, err)
+			}
+		}
+		if config.Impair != nil {
+			if err := config.Impair.validate(); err != nil {
+				return fmt.Errorf("%v: %v", dest, err)
+			}
+		}
+		for _, rule := range config.Faults {
+			if err := rule.load(); err != nil {
+				return fmt.Errorf("%v: %v", dest, err)
+			}
+		}
+	}
+	destinationConfigs = configs
+	return nil
+}
+
+//ConfigureDevices installs per-device settings. Settings are keyed by the
+//client's IP address.
+func ConfigureDevices(configs map[string]*DeviceConfig) (err error) {
+	for ip, config := range configs {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("%q is not an IP address", ip)
+		}
+		config.certificate, err = tls.LoadX509KeyPair(config.Cert, config.Key)
+		if err != nil {
+			return fmt.Errorf("%v: %v", ip, err)
+		}
+	}
+	deviceConfigs = configs
+	return nil
+}
+
+//deviceConfig returns the settings for pipes from client, or nil if there
+//are none.
+func deviceConfig(client net.Addr) *DeviceConfig {
+	host, _, err := net.SplitHostPort(client.String())
+	if err != nil {
+		return nil
+	}
+	for ip, config := range deviceConfigs {
+		if net.ParseIP(ip).Equal(net.ParseIP(host)) {
+			return config
+		}
+	}
+	return nil
+}
+
+//LookupDestination returns the settings for pipes to addr, or nil if there
+//are none.
+func LookupDestination(addr string) *DestinationConfig {
+	return destinationConfig(addr)
+}
+
+//destinationConfig returns the settings for the pipe to the first of addrs
+//that has any, or nil if none do. For each address, "host:port" is tried
+//before "host". Ports are tried after all hosts.
+func destinationConfig(addrs ...string) *DestinationConfig {
+	var keys, ports []string
+	for _, addr := range addrs {
+		keys = append(keys, addr)
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			keys = append(keys, host)
+			ports = append(ports, ":"+port)
+		}
+	}
+	for _, key := range append(append(keys, ports...), "*") {
+		if config, ok := destinationConfigs[key]; ok {
+			return config
+		}
+	}
+	return nil
+}
+
+//load builds the tls.Config described by st.
+func (st *ServerTLS) load() (err error) {
+	config := &tls.Config{InsecureSkipVerify: true, ServerName: st.ServerName}
+
+	if st.CA != "" {
+		bundle, err := os.ReadFile(st.CA)
+		if err != nil {
+			return err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(bundle) {
+			return errors.New("no certificates in " + st.CA)
+		}
+		config.InsecureSkipVerify = false
+	}
+
+	if len(st.Pins) > 0 {
+		var pins [][]byte
+		for _, pin := range st.Pins {
+			hash, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(hash) != sha256.Size {
+				return fmt.Errorf("invalid pin %q", pin)
+			}
+			pins = append(pins, hash)
+		}
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, cert := range state.PeerCertificates {
+				hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				for _, pin := range pins {
+					if bytes.Equal(hash[:], pin) {
+						return nil
+					}
+				}
+			}
+			return errors.New("server certificate does not match any pin")
+		}
+	}
+
+	if st.Cert != "" || st.Key != "" {
+		cert, err := tls.LoadX509KeyPair(st.Cert, st.Key)
+		if err != nil {
+			return err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if config.MinVersion, err = tlsVersion(st.MinVersion); err != nil {
+		return
+	}
+	if config.MaxVersion, err = tlsVersion(st.MaxVersion); err != nil {
+		return
+	}
+
+	if len(st.Ciphers) > 0 {
+		ids := make(map[string]uint16)
+		for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			ids[suite.Name] = suite.ID
+		}
+		for _, name := range st.Ciphers {
+			id, ok := ids[name]
+			if !ok {
+				return fmt.Errorf("unknown cipher suite %q", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+	}
+
+	st.config = config
+	return nil
+}
+
+//tlsVersion converts a version like "1.2" to its crypto/tls constant. An
+//empty version is 0, which leaves the choice to crypto/tls.
+func tlsVersion(version string) (uint16, error) {
+	switch version {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q", version)
+}
@@ -0,0 +1,216 @@
+package pipe
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"regexp"
+	"time"
+)
+
+//Fault is a failure injected into a pipe, aimed at one of its ends.
+type Fault struct {
+	//Action is one of:
+	//
+	//  "reset"    close the pipe, resetting the TCP connection to the
+	//             targeted end with an RST instead of a FIN.
+	//  "truncate" write only part of the next chunk of data to the
+	//             targeted end, then close the pipe.
+	//  "stall"    hold back data for the targeted end for Duration.
+	//  "corrupt"  flip random bits in the next chunks of data written to
+	//             the targeted end.
+	Action string `json:"action"`
+
+	//To is the end of the pipe the fault is aimed at, "client" or
+	//"server".
+	To string `json:"to"`
+
+	//Bytes is how many bytes of the chunk "truncate" lets through. Zero
+	//lets half of it through.
+	Bytes int `json:"bytes"`
+
+	//Duration is how long "stall" holds back data.
+	Duration Duration `json:"duration"`
+
+	//Bits is how many bits "corrupt" flips in each chunk. Zero flips one.
+	Bits int `json:"bits"`
+
+	//Chunks is how many chunks "corrupt" corrupts. Zero corrupts one.
+	Chunks int `json:"chunks"`
+}
+
+//FaultRule injects a fault when a chunk of data on its way to the end of the
+//pipe the fault is aimed at matches a regular expression. The fault takes
+//effect on the matching chunk: a reset keeps it from being sent, and a
+//truncation or corruption applies to it.
+type FaultRule struct {
+	Fault
+
+	//Match is a regular expression matched against every chunk of data
+	//written to the end the fault is aimed at. Binary data can be matched
+	//with escapes like \x00.
+	Match string `json:"match"`
+
+	match *regexp.Regexp
+}
+
+//faults holds the faults armed against one end of a pipe.
+type faults struct {
+	truncating bool
+	truncate   int
+	stallUntil time.Time
+	corrupt    int
+	bits       int
+}
+
+func (f *Fault) validate() error {
+	switch f.Action {
+	case "reset", "truncate", "stall", "corrupt":
+	default:
+		return fmt.Errorf("unknown fault action %q", f.Action)
+	}
+	if f.To != "client" && f.To != "server" {
+		return fmt.Errorf("fault must be aimed at the \"client\" or \"server\", not %q", f.To)
+	}
+	//Zero bytes, bits and chunks pick the defaults, but nothing picks a
+	//negative number or a stall that doesn't hold anything back.
+	switch {
+	case f.Action == "stall" && f.Duration <= 0:
+		return fmt.Errorf("stall duration must be positive, not %v", time.Duration(f.Duration))
+	case f.Action == "truncate" && f.Bytes < 0:
+		return fmt.Errorf("truncate bytes can't be negative, not %v", f.Bytes)
+	case f.Action == "corrupt" && (f.Bits < 0 || f.Chunks < 0):
+		return fmt.Errorf("corrupt bits and chunks can't be negative, not %v and %v", f.Bits, f.Chunks)
+	}
+	return nil
+}
+
+//load compiles the rule's regular expression.
+func (r *FaultRule) load() (err error) {
+	if err = r.validate(); err != nil {
+		return
+	}
+	r.match, err = regexp.Compile(r.Match)
+	return
+}
+
+//faultRulesFor returns the fault rules of the pipe to addr.
+func faultRulesFor(addr string) []*FaultRule {
+	if dest := destinationConfig(addr); dest != nil {
+		return dest.Faults
+	}
+	return nil
+}
+
+//Fault injects fault into the pipe. Resets take effect immediately; the
+//other faults take effect on the next chunk of data written to the end they
+//are aimed at. Fault is safe for use in multiple goroutines.
+func (t *TrudyPipe) Fault(fault Fault) error {
+	if err := fault.validate(); err != nil {
+		return err
+	}
+	log.Printf("[INFO] ( %v ) Injecting %v fault toward the %v.\n", t.id, fault.Action, fault.To)
+	t.pipeMutex.Lock()
+	conn, armed := t.clientConn, &t.clientFaults
+	if fault.To == "server" {
+		conn, armed = t.serverConn, &t.serverFaults
+	}
+	t.pipeMutex.Unlock()
+	if fault.Action == "reset" {
+		return t.reset(conn)
+	}
+
+	t.pipeMutex.Lock()
+	defer t.pipeMutex.Unlock()
+	switch fault.Action {
+	case "truncate":
+		armed.truncating = true
+		armed.truncate = fault.Bytes
+	case "stall":
+		armed.stallUntil = time.Now().Add(time.Duration(fault.Duration))
+	case "corrupt":
+		armed.corrupt = fault.Chunks
+		if armed.corrupt == 0 {
+			armed.corrupt = 1
+		}
+		armed.bits = fault.Bits
+		if armed.bits == 0 {
+			armed.bits = 1
+		}
+	}
+	return nil
+}
+
+//reset closes the pipe, making the TCP connection beneath conn send an RST.
+func (t *TrudyPipe) reset(conn net.Conn) error {
+	for c := conn; c != nil; c = unwrap(c) {
+		if tcpConn, ok := c.(*net.TCPConn); ok {
+			//Close the TCP connection itself, so a TLS connection on
+			//top of it doesn't send close_notify first.
+			tcpConn.SetLinger(0)
+			tcpConn.Close()
+			t.Close()
+			return nil
+		}
+	}
+	return errors.New("only TCP connections can be reset")
+}
+
+//writeFaulty writes buffer to conn, which is one end of the pipe, after
+//firing the fault rules that match it and applying the faults armed against
+//that end. The data is then written through line as degraded by impairment.
+func (t *TrudyPipe) writeFaulty(conn net.Conn, buffer []byte, to string, armed *faults, line **delayLine, impairment *Impairment) (n int, err error) {
+	for _, rule := range t.faultRules {
+		if rule.To == to && rule.match.Match(buffer) {
+			if err := t.Fault(rule.Fault); err != nil {
+				log.Printf("[ERR] ( %v ) Failed to inject %v fault: %v\n", t.id, rule.Action, err)
+			}
+		}
+	}
+
+	t.pipeMutex.Lock()
+	stall := time.Until(armed.stallUntil)
+	truncating, truncate := armed.truncating, armed.truncate
+	armed.truncating = false
+	bits := 0
+	if armed.corrupt > 0 {
+		armed.corrupt--
+		bits = armed.bits
+	}
+	t.pipeMutex.Unlock()
+
+	if stall > 0 {
+		time.Sleep(stall)
+	}
+	if bits > 0 && len(buffer) > 0 {
+		buffer = append([]byte{}, buffer...)
+		for i := 0; i < bits; i++ {
+			bit := rand.Intn(len(buffer) * 8)
+			buffer[bit/8] ^= 1 << (bit % 8)
+		}
+	}
+	if !truncating {
+		return t.writeImpaired(conn, buffer, line, impairment)
+	}
+	n, err = t.writeImpaired(conn, buffer[:truncated(truncate, len(buffer))], line, impairment)
+	t.flush(*line)
+	t.Close()
+	if err == nil {
+		err = net.ErrClosed
+	}
+	return
+}
+
+//truncated returns how many bytes of an n byte chunk a truncate fault lets
+//through when it is asked to let through keep bytes.
+func truncated(keep int, n int) int {
+	if keep <= 0 {
+		return n / 2
+	}
+	if keep > n {
+		return n
+	}
+	return keep
+}
@@ -0,0 +1,120 @@
+package pipe
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFaultRuleLoad(t *testing.T) {
+	tests := []struct {
+		name string
+		rule FaultRule
+		err  bool
+	}{
+		{name: "reset", rule: FaultRule{Fault: Fault{Action: "reset", To: "client"}, Match: "QUIT"}},
+		{name: "truncate", rule: FaultRule{Fault: Fault{Action: "truncate", To: "server", Bytes: 4}, Match: `\x00\x01`}},
+		{name: "stall", rule: FaultRule{Fault: Fault{Action: "stall", To: "client", Duration: Duration(time.Second)}}},
+		{name: "stall without a duration", rule: FaultRule{Fault: Fault{Action: "stall", To: "client"}}, err: true},
+		{name: "negative stall", rule: FaultRule{Fault: Fault{Action: "stall", To: "client", Duration: -1}}, err: true},
+		{name: "truncate to the default", rule: FaultRule{Fault: Fault{Action: "truncate", To: "client"}}},
+		{name: "negative truncate", rule: FaultRule{Fault: Fault{Action: "truncate", To: "client", Bytes: -1}}, err: true},
+		{name: "negative bits", rule: FaultRule{Fault: Fault{Action: "corrupt", To: "server", Bits: -1}}, err: true},
+		{name: "negative chunks", rule: FaultRule{Fault: Fault{Action: "corrupt", To: "server", Chunks: -1}}, err: true},
+		{name: "corrupt", rule: FaultRule{Fault: Fault{Action: "corrupt", To: "server"}, Match: "^GET "}},
+		{name: "unknown action", rule: FaultRule{Fault: Fault{Action: "explode", To: "client"}}, err: true},
+		{name: "unknown end", rule: FaultRule{Fault: Fault{Action: "reset", To: "both"}}, err: true},
+		{name: "no end", rule: FaultRule{Fault: Fault{Action: "reset"}}, err: true},
+		{name: "bad expression", rule: FaultRule{Fault: Fault{Action: "reset", To: "client"}, Match: "("}, err: true},
+	}
+	for _, test := range tests {
+		if err := test.rule.load(); (err != nil) != test.err {
+			t.Errorf("%v: got %v", test.name, err)
+		}
+	}
+}
+
+func TestFaultRuleMatch(t *testing.T) {
+	tests := []struct {
+		match string
+		data  string
+		want  bool
+	}{
+		{"QUIT", "QUIT\r\n", true},
+		{"QUIT", "quit\r\n", false},
+		{"(?i)QUIT", "quit\r\n", true},
+		{"^GET ", "POST / HTTP/1.1", false},
+		{`\x00\x01`, "\xff\x00\x01\xff", true},
+		{`\x00\x01`, "\x01\x00", false},
+		{"", "anything", true},
+	}
+	for _, test := range tests {
+		rule := FaultRule{Fault: Fault{Action: "reset", To: "client"}, Match: test.match}
+		if err := rule.load(); err != nil {
+			t.Fatalf("%q: %v", test.match, err)
+		}
+		if got := rule.match.Match([]byte(test.data)); got != test.want {
+			t.Errorf("%q against %q: got %v, want %v", test.match, test.data, got, test.want)
+		}
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	tests := []struct {
+		keep int
+		n    int
+		want int
+	}{
+		{keep: 0, n: 10, want: 5},
+		{keep: 0, n: 11, want: 5},
+		{keep: 0, n: 1, want: 0},
+		{keep: 0, n: 0, want: 0},
+		{keep: 3, n: 10, want: 3},
+		{keep: 10, n: 10, want: 10},
+		{keep: 20, n: 10, want: 10},
+		{keep: -1, n: 10, want: 5},
+	}
+	for _, test := range tests {
+		if got := truncated(test.keep, test.n); got != test.want {
+			t.Errorf("keeping %v of %v bytes: got %v, want %v", test.keep, test.n, got, test.want)
+		}
+	}
+}
+
+func TestWriteFaultyTruncate(t *testing.T) {
+	clientEnd, trudyEnd := net.Pipe()
+	defer clientEnd.Close()
+	serverEnd, _ := net.Pipe()
+	p := new(TrudyPipe)
+	p.prepare(0, trudyEnd)
+	p.init(0, "example.com:80", trudyEnd, serverEnd, DefaultTimeouts)
+	rule := &FaultRule{Fault: Fault{Action: "truncate", To: "client", Bytes: 3}, Match: "^BYE"}
+	if err := rule.load(); err != nil {
+		t.Fatal(err)
+	}
+	p.faultRules = []*FaultRule{rule}
+
+	received := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(clientEnd)
+		received <- data
+	}()
+	if _, err := p.WriteToClient([]byte("HELLO ")); err != nil {
+		t.Fatal(err)
+	}
+	//Rules aimed at the other end don't fire.
+	rule.To = "server"
+	if _, err := p.WriteToClient([]byte("BYE? ")); err != nil {
+		t.Fatal(err)
+	}
+	rule.To = "client"
+	n, err := p.WriteToClient([]byte("BYE NOW"))
+	if n != 3 || !errors.Is(err, net.ErrClosed) {
+		t.Errorf("truncated write: got %v, %v", n, err)
+	}
+	if got := string(<-received); got != "HELLO BYE? BYE" {
+		t.Errorf("the client got %q", got)
+	}
+}
@@ -0,0 +1,51 @@
+package pipe
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"sync"
+)
+
+//BeforeDial, if set, is called by New before the server end of pipe id is
+//dialed, with the client's address and the destination the client intended
+//to reach. It returns the destination to dial instead, which is usually the
+//same one, or an error to refuse the connection. A refused connection is
+//closed and New returns the error. A redirected pipe reports the new
+//destination from Destination and uses its settings.
+var BeforeDial func(id uint, client net.Addr, destination string) (string, error)
+
+//redirected holds the destinations BeforeDial chose for TLS connections
+//whose handshake has yet to run, keyed like mirrored, so MirrorTLS dials the
+//same server New would.
+var redirected sync.Map
+
+//beforeDial runs BeforeDial, if set, for pipe id to addr and returns the
+//destination to dial.
+func beforeDial(id uint, clientConn net.Conn, addr string) (string, error) {
+	if BeforeDial == nil {
+		return addr, nil
+	}
+	dest, err := BeforeDial(id, clientConn.RemoteAddr(), addr)
+	if err != nil {
+		log.Printf("[INFO] ( %v ) Connection to %v refused: %v\n", id, addr, err)
+		return "", err
+	}
+	if dest != addr {
+		log.Printf("[INFO] ( %v ) Redirecting connection to %v to %v.\n", id, addr, dest)
+		if tlsConn, ok := clientConn.(*tls.Conn); ok {
+			redirected.Store(tlsConn.NetConn(), dest)
+		}
+	}
+	return dest, nil
+}
+
+//redirection returns the destination BeforeDial chose for the client
+//connection conn that a TLS connection is built on, if it chose another one.
+func redirection(conn net.Conn) (string, bool) {
+	dest, ok := redirected.Load(conn)
+	if !ok {
+		return "", false
+	}
+	return dest.(string), true
+}
@@ -0,0 +1,267 @@
+package pipe
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"time"
+)
+
+//Impairment degrades one direction of a pipe, like a bad network link would.
+//Impairments act on the chunks of data written to the pipe, which are usually
+//the chunks read from the other end.
+type Impairment struct {
+	//Latency delays every chunk.
+	Latency Duration `json:"latency"`
+
+	//Jitter varies the delay of every chunk by up to this much either way.
+	Jitter Duration `json:"jitter"`
+
+	//Bandwidth limits the throughput to this many bytes per second. Zero
+	//means no limit.
+	Bandwidth int64 `json:"bandwidth"`
+
+	//Loss is the probability, between 0 and 1, that a chunk is dropped.
+	//Dropped chunks are never sent, so a TCP stream loses data rather
+	//than being retransmitted.
+	Loss float64 `json:"loss"`
+
+	//Segment splits chunks into writes of at most this many bytes. Zero
+	//leaves chunks whole.
+	Segment int `json:"segment"`
+}
+
+//Impairments holds the impairments of both directions of a pipe. A nil
+//Impairment leaves its direction alone.
+type Impairments struct {
+	//ToServer impairs the data the client sends to the server.
+	ToServer *Impairment `json:"toserver"`
+
+	//ToClient impairs the data the server sends to the client.
+	ToClient *Impairment `json:"toclient"`
+}
+
+//DefaultImpairments are the impairments of pipes to destinations without
+//impairments of their own.
+var DefaultImpairments Impairments
+
+//impairmentsFor returns the impairments of the pipe to addr.
+func impairmentsFor(addr string) Impairments {
+	if dest := destinationConfig(addr); dest != nil && dest.Impair != nil {
+		return *dest.Impair
+	}
+	return DefaultImpairments
+}
+
+//delay returns how long to hold back the next chunk.
+func (i *Impairment) delay() time.Duration {
+	delay := time.Duration(i.Latency)
+	if i.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(2*int64(i.Jitter)+1)) - time.Duration(i.Jitter)
+	}
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+//transmit returns how long sending n bytes takes at the impaired bandwidth.
+func (i *Impairment) transmit(n int) time.Duration {
+	if i.Bandwidth <= 0 {
+		return 0
+	}
+	return time.Duration(int64(n) * int64(time.Second) / i.Bandwidth)
+}
+
+//Validate checks that the impairment can be applied.
+func (i *Impairment) Validate() error {
+	if i.Loss < 0 || i.Loss > 1 {
+		return fmt.Errorf("loss must be between 0 and 1, not %v", i.Loss)
+	}
+	return nil
+}
+
+//validate checks that both directions of the impairments can be applied.
+func (i Impairments) validate() error {
+	for _, impairment := range []*Impairment{i.ToServer, i.ToClient} {
+		if impairment == nil {
+			continue
+		}
+		if err := impairment.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//paced reports whether the impairment holds data back.
+func (i *Impairment) paced() bool {
+	return i.Latency > 0 || i.Jitter > 0 || i.Bandwidth > 0
+}
+
+//SetImpairments replaces the impairments of the pipe. SetImpairments is safe
+//for use in multiple goroutines.
+func (t *TrudyPipe) SetImpairments(impairments Impairments) error {
+	if err := impairments.validate(); err != nil {
+		return err
+	}
+	t.pipeMutex.Lock()
+	t.impairments = impairments
+	t.pipeMutex.Unlock()
+	return nil
+}
+
+//Impairments returns the impairments of the pipe.
+func (t *TrudyPipe) Impairments() Impairments {
+	t.pipeMutex.Lock()
+	defer t.pipeMutex.Unlock()
+	return t.impairments
+}
+
+//delayLine holds back the chunks written to one end of a pipe until they are
+//due and writes them, in order, from its own goroutine. Every chunk is
+//delayed from when it was written rather than from when the chunk before it
+//was sent, so latency holds data back without limiting throughput.
+type delayLine struct {
+	chunks chan delayed
+	last   time.Time //When the latest chunk is due.
+	failed chan struct{}
+	err    error //Set before failed is closed.
+}
+
+//delayed is a chunk of data queued on a delayLine. A chunk with flushed set
+//carries no data and closes flushed once every chunk before it is written.
+type delayed struct {
+	conn       net.Conn
+	data       []byte
+	due        time.Time
+	impairment *Impairment
+	flushed    chan struct{}
+}
+
+//delayLineLength is how many chunks a delayLine holds before writes to it
+//block.
+const delayLineLength = 64
+
+//writeImpaired writes buffer to conn, which is one end of the pipe, as
+//degraded by impairment. Once that end has been impaired with latency,
+//jitter or a bandwidth limit, every write to it is queued on line and
+//writeImpaired returns without waiting for the data to be sent. If sending
+//queued data fails, the pipe is closed and the error is returned by the next
+//write.
+func (t *TrudyPipe) writeImpaired(conn net.Conn, buffer []byte, line **delayLine, impairment *Impairment) (n int, err error) {
+	if impairment != nil && impairment.Loss > 0 && rand.Float64() < impairment.Loss {
+		return len(buffer), nil
+	}
+	if *line == nil {
+		if impairment == nil || !impairment.paced() {
+			return t.writeSegments(conn, buffer, impairment)
+		}
+		*line = &delayLine{chunks: make(chan delayed, delayLineLength), failed: make(chan struct{})}
+		go t.runDelayLine(*line)
+	}
+	due := time.Now()
+	if impairment != nil {
+		due = due.Add(impairment.delay())
+	}
+	//Data can't overtake the data written before it.
+	if due.Before((*line).last) {
+		due = (*line).last
+	}
+	(*line).last = due
+	chunk := delayed{conn: conn, data: append([]byte{}, buffer...), due: due, impairment: impairment}
+	if err = t.queue(*line, chunk); err != nil {
+		return 0, err
+	}
+	return len(buffer), nil
+}
+
+//queue adds chunk to line, waiting for room if line is full.
+func (t *TrudyPipe) queue(line *delayLine, chunk delayed) error {
+	select {
+	case <-line.failed:
+		return line.err
+	default:
+	}
+	select {
+	case line.chunks <- chunk:
+		return nil
+	case <-line.failed:
+		return line.err
+	case <-t.closed:
+		return net.ErrClosed
+	}
+}
+
+//flush waits until every chunk queued on line has been written, the pipe is
+//closed or writing fails. line may be nil.
+func (t *TrudyPipe) flush(line *delayLine) {
+	if line == nil {
+		return
+	}
+	flushed := make(chan struct{})
+	if t.queue(line, delayed{flushed: flushed}) != nil {
+		return
+	}
+	select {
+	case <-flushed:
+	case <-line.failed:
+	case <-t.closed:
+	}
+}
+
+//runDelayLine writes the chunks queued on line once they are due, until the
+//pipe is closed or a write fails.
+func (t *TrudyPipe) runDelayLine(line *delayLine) {
+	for {
+		var chunk delayed
+		select {
+		case chunk = <-line.chunks:
+		case <-t.closed:
+			return
+		}
+		if chunk.flushed != nil {
+			close(chunk.flushed)
+			continue
+		}
+		if wait := time.Until(chunk.due); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-t.closed:
+				timer.Stop()
+				return
+			}
+		}
+		if _, err := t.writeSegments(chunk.conn, chunk.data, chunk.impairment); err != nil {
+			line.err = err
+			close(line.failed)
+			log.Printf("[ERR] ( %v ) Failed to write delayed data: %v\n", t.id, err)
+			t.Close()
+			return
+		}
+	}
+}
+
+//writeSegments writes buffer to conn in the segments and at the bandwidth
+//of impairment, which may be nil.
+func (t *TrudyPipe) writeSegments(conn net.Conn, buffer []byte, impairment *Impairment) (n int, err error) {
+	if impairment == nil {
+		return t.write(conn, buffer)
+	}
+	for len(buffer) > 0 {
+		segment := buffer
+		if impairment.Segment > 0 && len(segment) > impairment.Segment {
+			segment = segment[:impairment.Segment]
+		}
+		written, err := t.write(conn, segment)
+		n += written
+		if err != nil {
+			return n, err
+		}
+		time.Sleep(impairment.transmit(written))
+		buffer = buffer[written:]
+	}
+	return
+}
@@ -0,0 +1,71 @@
+package pipe
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestImpairmentValidate(t *testing.T) {
+	tests := []struct {
+		loss float64
+		err  bool
+	}{
+		{0, false},
+		{0.5, false},
+		{1, false},
+		{-0.1, true},
+		{1.5, true},
+	}
+	for _, test := range tests {
+		impairment := &Impairment{Loss: test.loss}
+		if err := impairment.Validate(); (err != nil) != test.err {
+			t.Errorf("loss %v: got %v", test.loss, err)
+		}
+		if err := (Impairments{ToClient: impairment}).validate(); (err != nil) != test.err {
+			t.Errorf("loss %v toward the client: got %v", test.loss, err)
+		}
+	}
+}
+
+func TestDelayLine(t *testing.T) {
+	clientEnd, trudyEnd := net.Pipe()
+	defer clientEnd.Close()
+	serverEnd, _ := net.Pipe()
+	p := new(TrudyPipe)
+	p.prepare(0, trudyEnd)
+	p.init(0, "example.com:80", trudyEnd, serverEnd, DefaultTimeouts)
+	defer p.Close()
+
+	const chunks, latency = 20, 100 * time.Millisecond
+	impairment := &Impairment{Latency: Duration(latency)}
+	received := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(io.LimitReader(clientEnd, chunks))
+		received <- data
+	}()
+
+	start := time.Now()
+	var want []byte
+	for i := 0; i < chunks; i++ {
+		chunk := []byte{byte(i)}
+		want = append(want, chunk...)
+		if _, err := p.writeImpaired(trudyEnd, chunk, &p.clientLine, impairment); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed >= latency {
+		t.Errorf("writing took %v, longer than the latency", elapsed)
+	}
+	got := <-received
+	//Every chunk is delayed from when it was written, not one after
+	//another.
+	if elapsed := time.Since(start); elapsed < latency || elapsed > chunks*latency/2 {
+		t.Errorf("the chunks arrived after %v, want about %v", elapsed, latency)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
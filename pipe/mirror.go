@@ -0,0 +1,123 @@
+package pipe
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"sync"
+)
+
+//mirrored holds server connections dialed while a client's handshake was in
+//progress, keyed by the connection the client's tls.Conn is built on. New
+//picks them up instead of dialing the server itself.
+var mirrored sync.Map
+
+//MirrorTLS makes TLS connections accepted with config mirror the client's
+//parameters on the server end of the pipe. When a client's ClientHello
+//arrives, the server is dialed with the same SNI, ALPN protocols and TLS
+//versions the client offered, and the handshake with the client is then
+//completed with the protocol and TLS version the server selected. Without
+//this, clients that need ALPN (e.g. h2 or gRPC) fail to negotiate it with
+//Trudy. Since the server is dialed before the client has presented a
+//certificate, it must not ask for one that depends on the client's.
+func MirrorTLS(config *tls.Config) {
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		addr, err := OriginalDestination(hello.Conn)
+		if err != nil {
+			return nil, err
+		}
+		if dest, ok := redirection(hello.Conn); ok {
+			addr = dest
+		}
+		serverConfig := serverTLSConfig(addr, hello.Conn.RemoteAddr())
+		if serverConfig.ServerName == "" {
+			serverConfig.ServerName = hello.ServerName
+		}
+		serverConfig.NextProtos = hello.SupportedProtos
+		if serverConfig.MinVersion == 0 && serverConfig.MaxVersion == 0 {
+			serverConfig.MinVersion, serverConfig.MaxVersion = versionRange(hello.SupportedVersions)
+		}
+
+		dialer := dialerFor(hello.Conn, timeoutsFor(addr, DefaultTimeouts))
+		serverConn, err := tls.DialWithDialer(dialer, "tcp", addr, serverConfig)
+		if err != nil {
+			log.Printf("[ERR] Unable to connect to %v while mirroring the client's TLS parameters. %v\n", addr, err)
+			return nil, &mirrorError{err}
+		}
+		mirrored.Store(hello.Conn, serverConn)
+
+		state := serverConn.ConnectionState()
+		clientConfig := config.Clone()
+		clientConfig.GetConfigForClient = nil
+		clientConfig.NextProtos = nil
+		if state.NegotiatedProtocol != "" {
+			clientConfig.NextProtos = []string{state.NegotiatedProtocol}
+		}
+		clientConfig.MinVersion = state.Version
+		clientConfig.MaxVersion = state.Version
+		return clientConfig, nil
+	}
+}
+
+//mirrorError is returned by the handshake with a client when the server could
+//not be reached to mirror the client's parameters.
+type mirrorError struct {
+	error
+}
+
+func (e *mirrorError) Unwrap() error {
+	return e.error
+}
+
+//versionRange returns the lowest and highest of the TLS versions offered by a
+//client, ignoring GREASE values.
+func versionRange(versions []uint16) (min, max uint16) {
+	for _, version := range versions {
+		if version < tls.VersionTLS10 || version > tls.VersionTLS13 {
+			continue
+		}
+		if min == 0 || version < min {
+			min = version
+		}
+		if version > max {
+			max = version
+		}
+	}
+	return
+}
+
+//handshake completes the handshake with the client of clientConn and returns
+//the server connection dialed while mirroring the client's parameters, if
+//there is one. If the handshake fails, that connection is closed.
+func handshake(clientConn *tls.Conn) (serverConn net.Conn, err error) {
+	err = clientConn.Handshake()
+	if conn, ok := mirrored.LoadAndDelete(clientConn.NetConn()); ok {
+		serverConn = conn.(net.Conn)
+	}
+	if err != nil && serverConn != nil {
+		serverConn.Close()
+		serverConn = nil
+	}
+	return
+}
+
+//dialerFor returns the dialer used to connect to the server on behalf of the
+//client of clientConn, with the dial timeout and keepalive period of
+//timeouts. The dialer spoofs the client's address if clientConn (or a
+//connection it wraps) asks for it with SourceAddr.
+func dialerFor(clientConn net.Conn, timeouts Timeouts) *net.Dialer {
+	dialer := new(net.Dialer)
+	for c := clientConn; c != nil; c = unwrap(c) {
+		if src, ok := c.(SourceAddr); ok && src.SourceAddr() != nil {
+			dialer = transparentDialer(src.SourceAddr())
+			break
+		}
+	}
+	dialer.Timeout = timeouts.Dial
+	dialer.KeepAlive = timeouts.KeepAlive
+	if timeouts.KeepAlive == 0 {
+		//A zero KeepAlive would mean the net package's default.
+		dialer.KeepAlive = -1
+	}
+	return dialer
+}
@@ -0,0 +1,275 @@
+package pipe
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//AutoPassthrough makes Trudy pass TLS connections through untouched once a
+//client has rejected Trudy's certificate for the same host, which usually
+//means the client pins the server's certificate.
+var AutoPassthrough bool
+
+//FailedHostsWriter, if set, receives the name of every host whose client
+//rejected Trudy's certificate, one per line.
+var FailedHostsWriter io.Writer
+
+var failedHosts = struct {
+	sync.Mutex
+	hosts map[string]bool
+}{hosts: make(map[string]bool)}
+
+//AddFailedHost records that interception of host failed. With
+//AutoPassthrough, later TLS connections to host are passed through.
+func AddFailedHost(host string) {
+	failedHosts.Lock()
+	defer failedHosts.Unlock()
+	if failedHosts.hosts[host] {
+		return
+	}
+	failedHosts.hosts[host] = true
+	if FailedHostsWriter != nil {
+		io.WriteString(FailedHostsWriter, host+"\n")
+	}
+}
+
+//hostFailed reports whether interception of host has failed before.
+func hostFailed(host string) bool {
+	failedHosts.Lock()
+	defer failedHosts.Unlock()
+	return failedHosts.hosts[host]
+}
+
+//Peeker is implemented by client connections whose first bytes can be looked
+//at before they are read.
+type Peeker interface {
+	//Peek returns the next n bytes without reading them.
+	Peek(n int) ([]byte, error)
+}
+
+//peekClientHello returns the ClientHello waiting to be read on the
+//connection beneath clientConn, or nil if there is none or it can't be
+//peeked at.
+func peekClientHello(clientConn *tls.Conn) *clientHello {
+	for c := clientConn.NetConn(); c != nil; c = unwrap(c) {
+		peeker, ok := c.(Peeker)
+		if !ok {
+			continue
+		}
+		header, err := peeker.Peek(5)
+		if err != nil || header[0] != 0x16 {
+			return nil
+		}
+		record, err := peeker.Peek(5 + int(binary.BigEndian.Uint16(header[3:5])))
+		if err != nil {
+			return nil
+		}
+		hello, err := parseClientHello(record[5:])
+		if err != nil {
+			return nil
+		}
+		return hello
+	}
+	return nil
+}
+
+//passthroughHost returns the name interception of the TLS connection to addr
+//is tracked under: the SNI if the client sent one, or the host of addr.
+func passthroughHost(addr string, hello *clientHello) string {
+	if hello != nil && hello.serverName != "" {
+		return hello.serverName
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	return host
+}
+
+//passthrough reports whether the TLS connection to addr described by hello
+//should be passed through instead of intercepted.
+func passthrough(addr string, hello *clientHello) bool {
+	addrs := []string{addr}
+	if hello != nil && hello.serverName != "" {
+		_, port, _ := net.SplitHostPort(addr)
+		addrs = []string{net.JoinHostPort(hello.serverName, port), addr}
+	}
+	if dest := destinationConfig(addrs...); dest != nil && dest.Passthrough {
+		return true
+	}
+	return AutoPassthrough && hostFailed(passthroughHost(addr, hello))
+}
+
+//certificateAlerts are the alerts a client sends when it rejects the
+//certificate it was presented (bad_certificate, certificate_unknown and
+//unknown_ca), as crypto/tls words them.
+var certificateAlerts = map[string]bool{
+	"tls: bad certificate":               true,
+	"tls: unknown certificate":           true,
+	"tls: unknown certificate authority": true,
+}
+
+//clientRejected reports whether err, from a failed handshake with a client,
+//is the client rejecting Trudy's certificate with an alert. Clients that
+//hang up or time out during the handshake have not rejected anything, and
+//neither has one whose handshake failed because the server, dialed while
+//mirroring, sent an alert of its own.
+func clientRejected(err error) bool {
+	var mirrorErr *mirrorError
+	if errors.As(err, &mirrorErr) {
+		return false
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "remote error" && certificateAlerts[opErr.Err.Error()]
+}
+
+//clientHello holds the fields of a TLS ClientHello that identify a client.
+type clientHello struct {
+	version      uint16
+	serverName   string
+	alpn         []string
+	cipherSuites []uint16
+	extensions   []uint16
+	groups       []uint16
+	pointFormats []uint8
+}
+
+//parseClientHello parses a ClientHello handshake message.
+func parseClientHello(msg []byte) (hello *clientHello, err error) {
+	r := &helloReader{b: msg}
+	if r.uint8() != 0x01 {
+		return nil, errors.New("not a ClientHello")
+	}
+	r.bytes(3)
+	hello = &clientHello{version: r.uint16()}
+	r.bytes(32)
+	r.bytes(int(r.uint8()))
+	suites := &helloReader{b: r.bytes(int(r.uint16()))}
+	for len(suites.b) >= 2 {
+		hello.cipherSuites = append(hello.cipherSuites, suites.uint16())
+	}
+	r.bytes(int(r.uint8()))
+
+	extensions := &helloReader{b: r.bytes(int(r.uint16()))}
+	for len(extensions.b) >= 4 {
+		typ := extensions.uint16()
+		data := &helloReader{b: extensions.bytes(int(extensions.uint16()))}
+		hello.extensions = append(hello.extensions, typ)
+		switch typ {
+		case 0: //server_name
+			names := &helloReader{b: data.bytes(int(data.uint16()))}
+			for len(names.b) >= 3 {
+				nameType := names.uint8()
+				name := names.bytes(int(names.uint16()))
+				if nameType == 0 {
+					hello.serverName = string(name)
+				}
+			}
+		case 10: //supported_groups
+			groups := &helloReader{b: data.bytes(int(data.uint16()))}
+			for len(groups.b) >= 2 {
+				hello.groups = append(hello.groups, groups.uint16())
+			}
+		case 11: //ec_point_formats
+			hello.pointFormats = data.bytes(int(data.uint8()))
+		case 16: //application_layer_protocol_negotiation
+			protos := &helloReader{b: data.bytes(int(data.uint16()))}
+			for len(protos.b) > 0 {
+				hello.alpn = append(hello.alpn, string(protos.bytes(int(protos.uint8()))))
+			}
+		}
+	}
+	if r.err {
+		return nil, errors.New("malformed ClientHello")
+	}
+	return hello, nil
+}
+
+//ja3 returns the JA3 fingerprint of the ClientHello: the MD5 hash of its
+//version, cipher suites, extensions, supported groups and point formats,
+//with GREASE values left out.
+func (h *clientHello) ja3() string {
+	join := func(values []uint16) string {
+		var s []string
+		for _, v := range values {
+			if !isGREASE(v) {
+				s = append(s, strconv.Itoa(int(v)))
+			}
+		}
+		return strings.Join(s, "-")
+	}
+	var formats []uint16
+	for _, f := range h.pointFormats {
+		formats = append(formats, uint16(f))
+	}
+	ja3 := fmt.Sprintf("%d,%s,%s,%s,%s", h.version, join(h.cipherSuites), join(h.extensions),
+		join(h.groups), join(formats))
+	hash := md5.Sum([]byte(ja3))
+	return hex.EncodeToString(hash[:])
+}
+
+func (h *clientHello) String() string {
+	var suites []string
+	for _, suite := range h.cipherSuites {
+		if !isGREASE(suite) {
+			suites = append(suites, tls.CipherSuiteName(suite))
+		}
+	}
+	return fmt.Sprintf("SNI: %q ALPN: %v Cipher suites: %v JA3: %v", h.serverName, h.alpn,
+		strings.Join(suites, ","), h.ja3())
+}
+
+//isGREASE reports whether v is one of the reserved GREASE values (RFC 8701).
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+//helloReader reads the big-endian fields of a handshake message. Reading
+//past the end sets err and returns zero values.
+type helloReader struct {
+	b   []byte
+	err bool
+}
+
+func (r *helloReader) bytes(n int) []byte {
+	if n > len(r.b) {
+		r.err = true
+		r.b = nil
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *helloReader) uint8() uint8 {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *helloReader) uint16() uint16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+//logClientHello logs what the client of pipe id offered in its ClientHello.
+func logClientHello(id uint, prefix string, hello *clientHello) {
+	if hello == nil {
+		log.Printf("[INFO] ( %v ) %v\n", id, prefix)
+		return
+	}
+	log.Printf("[INFO] ( %v ) %v %v\n", id, prefix, hello)
+}
@@ -0,0 +1,88 @@
+package pipe
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+//selfSigned returns a certificate for example.com that no client trusts.
+func selfSigned(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1),
+		Subject:   pkix.Name{CommonName: "example.com"},
+		DNSNames:  []string{"example.com"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+//serverHandshakeError returns the error of a handshake with a client that
+//client runs against.
+func serverHandshakeError(t *testing.T, client func(net.Conn)) error {
+	serverEnd, clientEnd := net.Pipe()
+	defer serverEnd.Close()
+	go func() {
+		client(clientEnd)
+		clientEnd.Close()
+	}()
+	server := tls.Server(serverEnd, &tls.Config{Certificates: []tls.Certificate{selfSigned(t)}})
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	return server.Handshake()
+}
+
+func TestClientRejected(t *testing.T) {
+	remote := func(alert string) error {
+		return &net.OpError{Op: "remote error", Err: errors.New(alert)}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"bad_certificate", remote("tls: bad certificate"), true},
+		{"certificate_unknown", remote("tls: unknown certificate"), true},
+		{"unknown_ca", remote("tls: unknown certificate authority"), true},
+		{"other alert", remote("tls: handshake failure"), false},
+		{"EOF", io.EOF, false},
+		{"reset", &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, false},
+		{"timeout", &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, false},
+		{"server alert while mirroring", &mirrorError{remote("tls: bad certificate")}, false},
+	}
+	for _, test := range tests {
+		if got := clientRejected(test.err); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	err := serverHandshakeError(t, func(conn net.Conn) {
+		tls.Client(conn, &tls.Config{ServerName: "example.com"}).Handshake()
+	})
+	if !clientRejected(err) {
+		t.Errorf("client that doesn't trust the certificate: %v is not a rejection", err)
+	}
+	err = serverHandshakeError(t, func(conn net.Conn) {
+		conn.Write([]byte{0x16, 0x03, 0x01})
+	})
+	if err == nil || clientRejected(err) {
+		t.Errorf("client that hung up: %v is a rejection", err)
+	}
+}
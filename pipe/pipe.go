@@ -3,12 +3,17 @@ package pipe
 
 import (
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
 	"log"
 	"net"
 	"strconv"
 	"sync"
 	"syscall"
 	"time"
+	"unsafe"
 )
 
 //Netfilter/iptables adds a tcp header to identify original destination.
@@ -16,6 +21,14 @@ import (
 //intended destination (i.e. _not_ trudy)
 const SO_ORIGINAL_DST = 80
 
+//IP6T_SO_ORIGINAL_DST is the ip6tables equivalent of SO_ORIGINAL_DST.
+const IP6T_SO_ORIGINAL_DST = 80
+
+//KeyLogWriter, if set, receives the TLS secrets of every connection Trudy makes
+//to a server in NSS key log format, so captures of the server end of a pipe
+//can be decrypted by tools like Wireshark.
+var KeyLogWriter io.Writer
+
 //Pipe is the primary interface that handles connections. Pipe creates a
 //full-duplex pipe that passes data from the client to the server and vice
 //versa. A pipe is compromised of two connections. The client transparently
@@ -34,6 +47,11 @@ type Pipe interface {
 	//ClientInfo returns the net.Addr of the client-end of the pipe.
 	ClientInfo() (addr net.Addr)
 
+	//Destination returns the "host:port" the client originally intended to
+	//connect to. If the client named its destination (e.g. with a SOCKS or
+	//HTTP CONNECT request), the host may be a hostname.
+	Destination() string
+
 	//ReadFromClient reads data into the buffer from the client-end of the
 	//pipe. ReadFromClient returns the number of bytes read and an error
 	//value if an error or EOF occurred. Note: ReadFromClient can read a
@@ -59,7 +77,7 @@ type Pipe interface {
 	//communication.
 	ServerConn() (conn net.Conn)
 
-	//CilentConn returns the net.Conn responsible for client-end
+	//ClientConn returns the net.Conn responsible for client-end
 	//communication.
 	ClientConn() (conn net.Conn)
 
@@ -77,6 +95,20 @@ type Pipe interface {
 	//Close closes both connections of the Pipe.
 	Close()
 
+	//CloseWriteToServer tells the server that the client has finished
+	//sending (TCP half-close). The server can still send to the client. The
+	//Pipe is closed once both ends have finished sending.
+	CloseWriteToServer()
+
+	//CloseWriteToClient tells the client that the server has finished
+	//sending (TCP half-close). The client can still send to the server. The
+	//Pipe is closed once both ends have finished sending.
+	CloseWriteToClient()
+
+	//Fault injects a failure, such as a reset or a truncated write, into
+	//one end of the Pipe.
+	Fault(fault Fault) error
+
 	//Lock locks a per-Pipe mutex that can be used in modules for
 	//synchronization.
 	Lock()
@@ -96,19 +128,46 @@ type Pipe interface {
 	DeleteContext(key string)
 }
 
-//TODO(kkl): I don't think New needs to be part of the Pipe interface.
-//Removing this very specific constructor will allow for other methods
-//of getting trudy as a proxy (e.g. other transparent proxies, or
-//non-transparent proxies like SOCKS).
-
 //TrudyPipe implements the Pipe interface and can be used to proxy TCP connections.
 type TrudyPipe struct {
-	id         uint
-	serverConn net.Conn
-	clientConn net.Conn
-	pipeMutex  *sync.Mutex
-	userMutex  *sync.Mutex
-	KV         map[string]interface{}
+	//Accessed atomically, so they must stay 64-bit aligned.
+	lastActive      int64
+	bytesFromClient int64
+	bytesFromServer int64
+
+	id          uint
+	destination string
+	serverConn  net.Conn
+	clientConn  net.Conn
+	pipeMutex   *sync.Mutex
+	userMutex   *sync.Mutex
+	upgrade     *startTLS
+	timeouts    Timeouts
+	idleTimer   *time.Timer
+	started     time.Time
+	impairments Impairments
+	faultRules  []*FaultRule
+	clientDone  bool //The client has finished sending.
+	serverDone  bool //The server has finished sending.
+	KV          map[string]interface{}
+
+	//clientWriteMutex and serverWriteMutex serialize writes to each end,
+	//so data injected with Pipes never lands in the middle of a write by
+	//the handlers.
+	clientWriteMutex *sync.Mutex
+	serverWriteMutex *sync.Mutex
+
+	//clientLine and serverLine delay the data written to each end of an
+	//impaired pipe. Each is guarded by the write mutex of its end.
+	clientLine *delayLine
+	serverLine *delayLine
+
+	//closed is closed when the pipe is.
+	closed chan struct{}
+
+	//clientFaults and serverFaults are the faults armed against each end.
+	clientFaults faults
+	serverFaults faults
 }
 
 //Lock locks a mutex stored within TrudyPipe to allow for fine-grained
@@ -133,9 +192,12 @@ func (t *TrudyPipe) AddContext(key string, value interface{}) {
 }
 
 //GetContext retrieves a value in a TrudyPipe key/value data store.
-//GetContext returns the value and a bool indicating success.
+//GetContext returns the value and a bool indicating success. GetContext is
+//safe for use in multiple goroutines.
 func (t *TrudyPipe) GetContext(key string) (retval interface{}, ok bool) {
+	t.pipeMutex.Lock()
 	retval, ok = t.KV[key]
+	t.pipeMutex.Unlock()
 	return
 }
 
@@ -147,13 +209,19 @@ func (t *TrudyPipe) DeleteContext(key string) {
 	t.pipeMutex.Unlock()
 }
 
-//CilentConn returns the net.Conn responsible for client-end communication.
+//ClientConn returns the net.Conn responsible for client-end communication.
+//ClientConn is safe for use in multiple goroutines.
 func (t *TrudyPipe) ClientConn() net.Conn {
+	t.pipeMutex.Lock()
+	defer t.pipeMutex.Unlock()
 	return t.clientConn
 }
 
 //ServerConn returns the net.Conn responsible for server-end communication.
+//ServerConn is safe for use in multiple goroutines.
 func (t *TrudyPipe) ServerConn() net.Conn {
+	t.pipeMutex.Lock()
+	defer t.pipeMutex.Unlock()
 	return t.serverConn
 }
 
@@ -180,106 +248,436 @@ func (t *TrudyPipe) Id() uint {
 
 //ServerInfo returns the net.Addr of the server.
 func (t *TrudyPipe) ServerInfo() (addr net.Addr) {
-	addr = t.serverConn.RemoteAddr()
+	serverConn := t.ServerConn()
+	if serverConn == nil {
+		//The pipe failed to open.
+		return nil
+	}
+	addr = serverConn.RemoteAddr()
 	return
 }
 
+//Destination returns the "host:port" the client originally intended to
+//connect to.
+func (t *TrudyPipe) Destination() string {
+	return t.destination
+}
+
 //ClientInfo returns the net.Addr of the client.
 func (t *TrudyPipe) ClientInfo() (addr net.Addr) {
-	addr = t.clientConn.RemoteAddr()
+	addr = t.ClientConn().RemoteAddr()
 	return
 }
 
-//Close closes both ends of a TrudyPipe.
+//Close closes both ends of a TrudyPipe and removes it from Pipes.
 func (t *TrudyPipe) Close() {
-	t.serverConn.Close()
-	t.clientConn.Close()
+	t.pipeMutex.Lock()
+	serverConn, clientConn := t.serverConn, t.clientConn
+	t.pipeMutex.Unlock()
+	if serverConn != nil {
+		serverConn.Close()
+	}
+	clientConn.Close()
+	Pipes.Remove(t.id)
+	t.pipeMutex.Lock()
+	upgrade := t.upgrade
+	select {
+	case <-t.closed:
+	default:
+		close(t.closed)
+	}
+	if t.idleTimer != nil {
+		t.idleTimer.Stop()
+		t.idleTimer = nil
+	}
+	t.pipeMutex.Unlock()
+	if upgrade != nil {
+		t.finishStartTLS(upgrade)
+	}
 }
 
-//ReadFromClient reads data from the client end of the pipe. This is typically the proxy-unaware client.
-func (t *TrudyPipe) ReadFromClient(buffer []byte) (n int, err error) {
-	//TODO(kkl): Make timeouts configureable.
-	err = t.clientConn.SetReadDeadline(time.Now().Add(15 * time.Second))
-	if err != nil {
-		return
+//CloseWriteToServer shuts down the writing side of the server end of the pipe
+//once the client has finished sending and the data delayed by impairments has
+//been sent, so the server sees EOF while its replies still reach the client. The pipe is closed once the server has
+//finished sending too, or right away if the server end can't be half-closed.
+func (t *TrudyPipe) CloseWriteToServer() {
+	t.serverWriteMutex.Lock()
+	t.flush(t.serverLine)
+	t.serverWriteMutex.Unlock()
+	t.closeWrite(t.ServerConn(), &t.clientDone)
+}
+
+//CloseWriteToClient shuts down the writing side of the client end of the pipe
+//once the server has finished sending. See CloseWriteToServer.
+func (t *TrudyPipe) CloseWriteToClient() {
+	t.clientWriteMutex.Lock()
+	t.flush(t.clientLine)
+	t.clientWriteMutex.Unlock()
+	t.closeWrite(t.ClientConn(), &t.serverDone)
+}
+
+//closeWrite records that the direction ending at conn is done and
+//half-closes conn, closing the pipe if the other direction is done as well.
+func (t *TrudyPipe) closeWrite(conn net.Conn, done *bool) {
+	t.pipeMutex.Lock()
+	*done = true
+	finished := t.clientDone && t.serverDone
+	t.pipeMutex.Unlock()
+	if finished || !halfClose(conn) {
+		t.Close()
+	}
+}
+
+//halfClose calls CloseWrite on conn and every connection it wraps, so a TLS
+//connection sends close_notify before its TCP connection sends FIN.
+//halfClose reports whether any of them could be half-closed.
+func halfClose(conn net.Conn) (ok bool) {
+	for c := conn; c != nil; c = unwrap(c) {
+		if cw, isCloseWriter := c.(interface{ CloseWrite() error }); isCloseWriter {
+			if cw.CloseWrite() != nil {
+				return false
+			}
+			ok = true
+		}
 	}
-	n, err = t.clientConn.Read(buffer)
 	return
 }
 
+//ReadFromClient reads data from the client end of the pipe. This is typically the proxy-unaware client.
+//If the client has asked for a STARTTLS upgrade, ReadFromClient waits until
+//the server has answered.
+func (t *TrudyPipe) ReadFromClient(buffer []byte) (n int, err error) {
+	t.waitForStartTLS()
+	return t.read(t.ClientConn(), buffer, &t.bytesFromClient)
+}
+
 //WriteToClient writes data to the client end of the pipe. This is typically the proxy-unaware client.
+//If buffer is the server's acceptance of a STARTTLS upgrade, both ends of the
+//pipe are upgraded to TLS after it is written.
 func (t *TrudyPipe) WriteToClient(buffer []byte) (n int, err error) {
-	//TODO(kkl): Make timeouts configureable.
-	err = t.clientConn.SetWriteDeadline(time.Now().Add(15 * time.Second))
-	if err != nil {
-		return
+	t.clientWriteMutex.Lock()
+	defer t.clientWriteMutex.Unlock()
+	if handled, n, err := t.startTLSReply(buffer); handled {
+		return n, err
 	}
-	n, err = t.clientConn.Write(buffer)
-	return
+	return t.writeFaulty(t.ClientConn(), buffer, "client", &t.clientFaults, &t.clientLine, t.Impairments().ToClient)
 }
 
 //ReadFromServer reads data from the server end of the pipe. The server is the
 //proxy-unaware client's intended destination.
 func (t *TrudyPipe) ReadFromServer(buffer []byte) (n int, err error) {
-	t.serverConn.SetReadDeadline(time.Now().Add(15 * time.Second))
-	return t.serverConn.Read(buffer)
+	return t.read(t.ServerConn(), buffer, &t.bytesFromServer)
 }
 
 //WriteToServer writes data to the server end of the pipe. The server is the
-//proxy-unaware client's intended destination.
+//proxy-unaware client's intended destination. WriteToServer watches for
+//STARTTLS requests (see StartTLSConfig).
 func (t *TrudyPipe) WriteToServer(buffer []byte) (n int, err error) {
-	err = t.serverConn.SetWriteDeadline(time.Now().Add(15 * time.Second))
-	if err != nil {
-		return
+	t.serverWriteMutex.Lock()
+	defer t.serverWriteMutex.Unlock()
+	t.startTLSRequest(buffer)
+	return t.writeFaulty(t.ServerConn(), buffer, "server", &t.serverFaults, &t.serverLine, t.Impairments().ToServer)
+}
+
+//Destination is implemented by client connections that already know the
+//client's original destination, such as connections accepted on a TPROXY
+//socket. New dials Destination instead of asking netfilter for it.
+type Destination interface {
+	//Destination returns the original destination as a "host:port"
+	//connection string.
+	Destination() string
+}
+
+//SourceAddr is implemented by client connections whose server end may need
+//to be dialed from a spoofed source address.
+type SourceAddr interface {
+	//SourceAddr returns the address the server end of the pipe should be
+	//dialed from, or nil to use one of Trudy's own addresses.
+	SourceAddr() net.Addr
+}
+
+//DialReporter is implemented by client connections whose client waits to
+//hear whether its destination could be reached before it sends anything,
+//such as a SOCKS client. New reports how dialing the server went before it
+//uses or closes the client connection.
+type DialReporter interface {
+	//ReportDial is called with the local address of the server end of the
+	//pipe, or with the error that kept the pipe from opening.
+	ReportDial(bound net.Addr, err error) error
+}
+
+//reportDial tells the client of clientConn how dialing serverConn went, if
+//clientConn (or a connection it wraps) implements DialReporter.
+func reportDial(clientConn net.Conn, serverConn net.Conn, err error) error {
+	for c := clientConn; c != nil; c = unwrap(c) {
+		if reporter, ok := c.(DialReporter); ok {
+			var bound net.Addr
+			if serverConn != nil {
+				bound = serverConn.LocalAddr()
+			}
+			return reporter.ReportDial(bound, err)
+		}
 	}
-	n, err = t.serverConn.Write(buffer)
-	return
+	return nil
+}
+
+//unwrap returns the connection conn is built on, or nil if conn does not wrap
+//another connection. TLS connections and the connections handed out by
+//Trudy's listeners expose what they wrap with a NetConn method.
+func unwrap(conn net.Conn) net.Conn {
+	if wrapper, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		return wrapper.NetConn()
+	}
+	return nil
+}
+
+//OriginalDestination returns the "host:port" the client of conn originally
+//intended to connect to. If conn (or a connection it wraps) implements
+//Destination, that destination is returned. Otherwise netfilter is asked for
+//the original destination of conn's socket.
+func OriginalDestination(conn net.Conn) (addr string, err error) {
+	for c := conn; c != nil; c = unwrap(c) {
+		if dest, ok := c.(Destination); ok {
+			return dest.Destination(), nil
+		}
+		if sc, ok := c.(syscall.Conn); ok {
+			raw, err := sc.SyscallConn()
+			if err != nil {
+				return "", err
+			}
+			cerr := raw.Control(func(fd uintptr) {
+				addr, err = getOriginalDst(int(fd), isIPv6(c))
+			})
+			if cerr != nil {
+				return "", cerr
+			}
+			return addr, err
+		}
+	}
+	return "", errors.New("no socket to get the original destination from")
 }
 
-//byteToConnString converts the Multiaddr bytestring returned by Getsockopt into a "host:port" connection string.
-func byteToConnString(multiaddr [16]byte) string {
-	ip := multiaddr[4:8]
-	ipString := net.IPv4(ip[0], ip[1], ip[2], ip[3]).String()
-	port := multiaddr[2:4]
-	portUint := int64((uint32(port[0]) << 8) + uint32(port[1]))
-	portString := strconv.FormatInt(portUint, 10)
-	return (ipString + ":" + portString)
+//isIPv6 reports whether conn is an IPv6 connection. IPv4 connections accepted
+//on a dual-stack socket are not.
+func isIPv6(conn net.Conn) bool {
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		return local.IP.To4() == nil
+	}
+	return false
+}
+
+//serverTLSConfig returns the config used for TLS connections to the server at
+//addr on behalf of client. It is built from the ServerTLS settings for addr
+//and the client certificate of client's DeviceConfig, if there are any.
+func serverTLSConfig(addr string, client net.Addr) *tls.Config {
+	config := &tls.Config{InsecureSkipVerify: true}
+	if dest := destinationConfig(addr); dest != nil && dest.TLS != nil {
+		config = dest.TLS.config.Clone()
+	}
+	if device := deviceConfig(client); device != nil {
+		config.Certificates = []tls.Certificate{device.certificate}
+	}
+	config.KeyLogWriter = KeyLogWriter
+	return config
+}
+
+//transparentDialer returns a net.Dialer that connects from src, which does
+//not need to be one of Trudy's addresses. The kernel will only route the
+//replies back to Trudy if the gateway is set up for TPROXY.
+func transparentDialer(src net.Addr) *net.Dialer {
+	var ip net.IP
+	if tcpAddr, ok := src.(*net.TCPAddr); ok {
+		ip = tcpAddr.IP
+	}
+	return &net.Dialer{LocalAddr: &net.TCPAddr{IP: ip},
+		Control: func(network, address string, c syscall.RawConn) (err error) {
+			cerr := c.Control(func(fd uintptr) {
+				level, opt := syscall.SOL_IP, syscall.IP_TRANSPARENT
+				if ip.To4() == nil {
+					level, opt = syscall.SOL_IPV6, unix.IPV6_TRANSPARENT
+				}
+				err = syscall.SetsockoptInt(int(fd), level, opt, 1)
+			})
+			if cerr != nil {
+				return cerr
+			}
+			return
+		}}
+}
+
+//getOriginalDst asks netfilter for the original destination of the
+//connection on fd and returns it as a "host:port" connection string. IPv4
+//connections (including IPv4-mapped connections accepted on a dual-stack
+//socket) are looked up with SO_ORIGINAL_DST, IPv6 connections with
+//IP6T_SO_ORIGINAL_DST.
+func getOriginalDst(fd int, ipv6 bool) (string, error) {
+	level, opt := syscall.SOL_IP, SO_ORIGINAL_DST
+	if ipv6 {
+		level, opt = syscall.SOL_IPV6, IP6T_SO_ORIGINAL_DST
+	}
+	//sockaddr_in6 is large enough to hold either answer.
+	var sa [syscall.SizeofSockaddrInet6]byte
+	size := uint32(len(sa))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt),
+		uintptr(unsafe.Pointer(&sa[0])), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return "", errno
+	}
+	return sockaddrToConnString(sa[:size], ipv6)
+}
+
+//sockaddrToConnString converts a raw sockaddr_in or sockaddr_in6 returned by
+//Getsockopt into a "host:port" connection string.
+func sockaddrToConnString(sa []byte, ipv6 bool) (string, error) {
+	size := syscall.SizeofSockaddrInet4
+	if ipv6 {
+		size = syscall.SizeofSockaddrInet6
+	}
+	if len(sa) < size {
+		return "", fmt.Errorf("original destination is %v bytes long, want %v", len(sa), size)
+	}
+	//Both structures start with a two byte family and a port in network
+	//byte order.
+	port := strconv.Itoa(int(sa[2])<<8 + int(sa[3]))
+	var ip net.IP
+	if ipv6 {
+		//sockaddr_in6 has four bytes of flow information before the
+		//address.
+		ip = make(net.IP, net.IPv6len)
+		copy(ip, sa[8:24])
+	} else {
+		ip = net.IPv4(sa[4], sa[5], sa[6], sa[7])
+	}
+	return net.JoinHostPort(ip.String(), port), nil
 }
 
 //New builds a new TrudyPipe. New will get the original destination of traffic
-//that was mangled by iptables and get the original destination. New will then
-//open a connection to that original destination and, upon success, will set
-//all the internal values needed for a TrudyPipe.
+//that was mangled by iptables or ip6tables and get the original destination.
+//If the client connection implements Destination, that destination is used
+//instead. New will then open a connection to that original destination and,
+//upon success, will set all the internal values needed for a TrudyPipe.
 func (t *TrudyPipe) New(id uint, fd int, clientConn net.Conn, useTLS bool) (err error) {
-	//TODO(kkl): Make the second argument system-dependent. E.g. If a linux machine: syscall.SOL_IP
-	originalAddrBytes, err := syscall.GetsockoptIPv6Mreq(fd, syscall.IPPROTO_IP, SO_ORIGINAL_DST)
+	t.prepare(id, clientConn)
+	var originalAddr string
+	for c := clientConn; c != nil && originalAddr == ""; c = unwrap(c) {
+		if dest, ok := c.(Destination); ok {
+			originalAddr = dest.Destination()
+		}
+	}
+	if originalAddr == "" {
+		originalAddr, err = getOriginalDst(fd, isIPv6(clientConn))
+		if err != nil {
+			log.Println("[DEBUG] Getsockopt failed.")
+			reportDial(clientConn, nil, err)
+			clientConn.Close()
+			return err
+		}
+	}
+	t.destination = originalAddr
+	originalAddr, err = beforeDial(id, clientConn, originalAddr)
+	if tlsConn, isTLS := clientConn.(*tls.Conn); isTLS {
+		defer redirected.Delete(tlsConn.NetConn())
+	}
 	if err != nil {
-		log.Println("[DEBUG] Getsockopt failed.")
+		reportDial(clientConn, nil, err)
 		clientConn.Close()
 		return err
 	}
+	t.destination = originalAddr
+
+	timeouts := timeoutsFor(originalAddr, DefaultTimeouts)
+	dialer := dialerFor(clientConn, timeouts)
 
 	var serverConn net.Conn
 	if useTLS {
-		tlsconfig := &tls.Config{InsecureSkipVerify: true}
-		serverConn, err = tls.Dial("tcp", byteToConnString(originalAddrBytes.Multiaddr), tlsconfig)
+		//Complete the client's handshake first, so the client certificate
+		//(if any) is known before the server asks for one. The exception
+		//is a listener whose config mirrors TLS parameters (see
+		//MirrorTLS): it dials the server during the handshake, before
+		//the client has presented a certificate.
+		if tlsConn, isTLS := clientConn.(*tls.Conn); isTLS {
+			tlsConn.SetDeadline(deadline(timeouts.Handshake))
+			hello := peekClientHello(tlsConn)
+			if passthrough(originalAddr, hello) {
+				logClientHello(id, "Passing TLS through.", hello)
+				clientConn = tlsConn.NetConn()
+				useTLS = false
+			} else {
+				serverConn, err = handshake(tlsConn)
+			}
+			tlsConn.SetDeadline(time.Time{})
+			if err != nil {
+				log.Printf("[ERR] ( %v ) TLS handshake with client failed. Closing pipe. %v\n", id, err)
+				if clientRejected(err) {
+					host := passthroughHost(originalAddr, hello)
+					AddFailedHost(host)
+					logClientHello(id, "Interception of "+host+" failed.", hello)
+				}
+				reportDial(clientConn, nil, err)
+				clientConn.Close()
+				return err
+			}
+		}
+	}
+	if useTLS && serverConn == nil {
+		serverConfig := serverTLSConfig(originalAddr, clientConn.RemoteAddr())
+		//A transparently proxied destination is an IP address, which
+		//servers rarely have certificates for, so the server name the
+		//client asked for is sent and verified instead.
+		if tlsConn, isTLS := clientConn.(*tls.Conn); isTLS && serverConfig.ServerName == "" {
+			serverConfig.ServerName = tlsConn.ConnectionState().ServerName
+		}
+		serverConn, err = tls.DialWithDialer(dialer, "tcp", originalAddr, serverConfig)
 		if err != nil {
-			log.Printf("[ERR] Unable to connect to destination. Closing connection %v.\n", id)
+			log.Printf("[ERR] Unable to connect to destination. Closing connection %v. %v\n", id, err)
+			reportDial(clientConn, nil, err)
 			clientConn.Close()
 			return err
 		}
-	} else {
-		serverConn, err = net.Dial("tcp", byteToConnString(originalAddrBytes.Multiaddr))
+	} else if !useTLS {
+		serverConn, err = dialer.Dial("tcp", originalAddr)
 		if err != nil {
 			log.Printf("[ERR] ( %v ) Unable to connect to destination. Closing pipe.\n", id)
+			reportDial(clientConn, nil, err)
 			clientConn.Close()
 			return err
 		}
 	}
+	if err = reportDial(clientConn, serverConn, nil); err != nil {
+		serverConn.Close()
+		clientConn.Close()
+		return err
+	}
+	setKeepAlive(clientConn, timeouts.KeepAlive)
+	t.init(id, originalAddr, clientConn, serverConn, timeouts)
+	return nil
+}
+
+//prepare sets up what a pipe that fails to open still needs, since it is
+//handed to the OnError hooks of modules: its id, its client end, its locks and
+//its context. Every New of a pipe built on TrudyPipe starts with it.
+func (t *TrudyPipe) prepare(id uint, clientConn net.Conn) {
 	t.id = id
 	t.clientConn = clientConn
-	t.serverConn = serverConn
 	t.pipeMutex = new(sync.Mutex)
 	t.userMutex = new(sync.Mutex)
-	return nil
+	t.clientWriteMutex = new(sync.Mutex)
+	t.serverWriteMutex = new(sync.Mutex)
+	t.KV = make(map[string]interface{})
+	t.closed = make(chan struct{})
+}
+
+//init sets up the pipe between clientConn and serverConn, the connection to
+//destination, once the server has been dialed. Every New of a pipe built on
+//TrudyPipe ends with it.
+func (t *TrudyPipe) init(id uint, destination string, clientConn net.Conn, serverConn net.Conn, timeouts Timeouts) {
+	t.id = id
+	t.destination = destination
+	t.clientConn = clientConn
+	t.serverConn = serverConn
+	t.timeouts = timeouts
+	t.started = time.Now()
+	t.impairments = impairmentsFor(destination)
+	t.faultRules = faultRulesFor(destination)
+	t.watchIdle()
 }
@@ -0,0 +1,175 @@
+package pipe
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSockaddrToConnString(t *testing.T) {
+	sockaddrIn := []byte{0x02, 0x00, 0x01, 0xbb, 10, 0, 0, 5, 0, 0, 0, 0, 0, 0, 0, 0}
+	sockaddrIn6 := []byte{0x0a, 0x00, 0x1f, 0x90, 0, 0, 0, 0,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01,
+		0, 0, 0, 0}
+	tests := []struct {
+		name string
+		sa   []byte
+		ipv6 bool
+		want string
+		err  bool
+	}{
+		{name: "IPv4", sa: sockaddrIn, want: "10.0.0.5:443"},
+		{name: "IPv6", sa: sockaddrIn6, ipv6: true, want: "[2001:db8::1]:8080"},
+		{name: "empty", sa: nil, err: true},
+		{name: "short IPv4", sa: sockaddrIn[:6], err: true},
+		{name: "short IPv6", sa: sockaddrIn6[:20], ipv6: true, err: true},
+		{name: "IPv4 answer to IPv6 query", sa: sockaddrIn, ipv6: true, err: true},
+	}
+	for _, test := range tests {
+		got, err := sockaddrToConnString(test.sa, test.ipv6)
+		if test.err {
+			if err == nil {
+				t.Errorf("%v: got %q, want an error", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+		} else if got != test.want {
+			t.Errorf("%v: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+//TestNewFailure checks that a pipe that fails to open can still be used by
+//OnError hooks.
+func TestNewFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		p    Pipe
+	}{
+		{"TrudyPipe without an original destination", new(TrudyPipe)},
+		{"UDPPipe on a TCP connection", new(UDPPipe)},
+	}
+	for _, test := range tests {
+		clientEnd, trudyEnd := net.Pipe()
+		clientEnd.Close()
+		if err := test.p.New(7, -1, trudyEnd, false); err == nil {
+			t.Errorf("%v: New succeeded", test.name)
+			continue
+		}
+		if test.p.Id() != 7 {
+			t.Errorf("%v: got id %v", test.name, test.p.Id())
+		}
+		if test.p.ClientInfo() == nil || test.p.ServerInfo() != nil {
+			t.Errorf("%v: got client %v and server %v", test.name, test.p.ClientInfo(), test.p.ServerInfo())
+		}
+		test.p.Lock()
+		test.p.Unlock()
+		test.p.AddContext("key", "value")
+		if value, ok := test.p.GetContext("key"); !ok || value != "value" {
+			t.Errorf("%v: got context %v, %v", test.name, value, ok)
+		}
+		test.p.DeleteContext("key")
+		test.p.Close()
+	}
+}
+
+//TestContextConcurrency finds unlocked context access when run with -race.
+func TestContextConcurrency(t *testing.T) {
+	p := new(TrudyPipe)
+	p.prepare(0, nil)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			p.AddContext("key", i)
+			p.DeleteContext("key")
+		}
+		close(done)
+	}()
+	for i := 0; i < 1000; i++ {
+		p.GetContext("key")
+	}
+	<-done
+}
+
+//destinationConn is a client connection that knows its original destination.
+type destinationConn struct {
+	net.Conn
+	destination string
+}
+
+func (c *destinationConn) Destination() string { return c.destination }
+
+func TestNewVerifiesClientServerName(t *testing.T) {
+	cert := selfSigned(t)
+	server, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			defer conn.Close()
+		}
+	}()
+
+	//The server is trusted, but its certificate names example.com rather
+	//than the IP address the client connected to.
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err = os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	addr := server.Addr().String()
+	if err = Configure(map[string]*DestinationConfig{addr: {TLS: &ServerTLS{CA: ca}}}); err != nil {
+		t.Fatal(err)
+	}
+	defer Configure(nil)
+
+	clientEnd, trudyEnd := net.Pipe()
+	defer clientEnd.Close()
+	go func() {
+		//Reading keeps the synchronous net.Pipe from stalling Trudy's
+		//writes after the handshake.
+		client := tls.Client(clientEnd, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+		io.Copy(io.Discard, client)
+	}()
+	clientConn := tls.Server(&destinationConn{Conn: trudyEnd, destination: addr}, &tls.Config{Certificates: []tls.Certificate{cert}})
+	p := new(TrudyPipe)
+	if err = p.New(0, -1, clientConn, true); err != nil {
+		t.Fatalf("the server wasn't verified against the client's server name: %v", err)
+	}
+	p.Close()
+}
+
+//TestConnConcurrency finds unlocked access to the ends of a pipe when run
+//with -race.
+func TestConnConcurrency(t *testing.T) {
+	clientEnd, trudyEnd := net.Pipe()
+	serverEnd, _ := net.Pipe()
+	p := new(TrudyPipe)
+	p.prepare(0, trudyEnd)
+	p.init(0, "example.com:80", trudyEnd, serverEnd, DefaultTimeouts)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			p.SetClientConn(clientEnd)
+			p.SetServerConn(serverEnd)
+		}
+		close(done)
+	}()
+	for i := 0; i < 1000; i++ {
+		Info(p)
+	}
+	<-done
+	p.Close()
+}
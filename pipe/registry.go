@@ -0,0 +1,164 @@
+package pipe
+
+import (
+	"crypto/tls"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Registry keeps track of the pipes that are open. It is safe for use in
+//multiple goroutines.
+type Registry struct {
+	mutex sync.Mutex
+	pipes map[uint]Pipe
+}
+
+//Pipes is the registry of every open pipe. Pipes are added once they have
+//been built and removed when they are closed.
+var Pipes = &Registry{pipes: make(map[uint]Pipe)}
+
+//PipeInfo describes an open pipe.
+type PipeInfo struct {
+	Id              uint      `json:"id"`
+	ClientAddr      string    `json:"client"`
+	ServerAddr      string    `json:"server"`
+	Destination     string    `json:"destination"`
+	Started         time.Time `json:"started"`
+	TLS             bool      `json:"tls"`
+	BytesFromClient int64     `json:"bytesfromclient"`
+	BytesFromServer int64     `json:"bytesfromserver"`
+	Context         []string  `json:"context"`
+
+	Impairments Impairments `json:"impairments"`
+}
+
+//Add registers p.
+func (r *Registry) Add(p Pipe) {
+	r.mutex.Lock()
+	r.pipes[p.Id()] = p
+	r.mutex.Unlock()
+}
+
+//Remove unregisters the pipe with the given id.
+func (r *Registry) Remove(id uint) {
+	r.mutex.Lock()
+	delete(r.pipes, id)
+	r.mutex.Unlock()
+}
+
+//Get returns the open pipe with the given id.
+func (r *Registry) Get(id uint) (p Pipe, ok bool) {
+	r.mutex.Lock()
+	p, ok = r.pipes[id]
+	r.mutex.Unlock()
+	return
+}
+
+//List describes every open pipe, ordered by id.
+func (r *Registry) List() []PipeInfo {
+	r.mutex.Lock()
+	pipes := make([]Pipe, 0, len(r.pipes))
+	for _, p := range r.pipes {
+		pipes = append(pipes, p)
+	}
+	r.mutex.Unlock()
+
+	infos := make([]PipeInfo, 0, len(pipes))
+	for _, p := range pipes {
+		infos = append(infos, Info(p))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Id < infos[j].Id })
+	return infos
+}
+
+//Kill closes the open pipe with the given id. Kill reports whether there was
+//such a pipe.
+func (r *Registry) Kill(id uint) bool {
+	p, ok := r.Get(id)
+	if ok {
+		p.Close()
+		r.Remove(id)
+	}
+	return ok
+}
+
+//InjectToClient writes data to the client end of the open pipe with the
+//given id, as if the server had sent it. data does not pass through the
+//modules. Writes by the pipe's handlers are never interleaved with data.
+func (r *Registry) InjectToClient(id uint, data []byte) (n int, err error) {
+	p, ok := r.Get(id)
+	if !ok {
+		return 0, errNoSuchPipe
+	}
+	return p.WriteToClient(data)
+}
+
+//InjectToServer writes data to the server end of the open pipe with the
+//given id, as if the client had sent it. See InjectToClient.
+func (r *Registry) InjectToServer(id uint, data []byte) (n int, err error) {
+	p, ok := r.Get(id)
+	if !ok {
+		return 0, errNoSuchPipe
+	}
+	return p.WriteToServer(data)
+}
+
+//Impair replaces the impairments of the open pipe with the given id.
+func (r *Registry) Impair(id uint, impairments Impairments) error {
+	p, ok := r.Get(id)
+	if !ok {
+		return errNoSuchPipe
+	}
+	impaired, ok := p.(interface{ SetImpairments(Impairments) error })
+	if !ok {
+		return errors.New("pipe can't be impaired")
+	}
+	return impaired.SetImpairments(impairments)
+}
+
+//Fault injects fault into the open pipe with the given id. See
+//TrudyPipe.Fault.
+func (r *Registry) Fault(id uint, fault Fault) error {
+	p, ok := r.Get(id)
+	if !ok {
+		return errNoSuchPipe
+	}
+	return p.Fault(fault)
+}
+
+var errNoSuchPipe = errors.New("no such pipe")
+
+//Info describes p. Start time, byte counters, context keys and impairments are
+//only known for pipes built on TrudyPipe.
+func Info(p Pipe) PipeInfo {
+	info := PipeInfo{Id: p.Id(), Destination: p.Destination(), Context: []string{}}
+	if addr := p.ClientInfo(); addr != nil {
+		info.ClientAddr = addr.String()
+	}
+	if addr := p.ServerInfo(); addr != nil {
+		info.ServerAddr = addr.String()
+	}
+	_, info.TLS = p.ClientConn().(*tls.Conn)
+	if t, ok := p.(interface{ stats(*PipeInfo) }); ok {
+		t.stats(&info)
+	}
+	return info
+}
+
+//stats adds the start time, byte counters, context keys and impairments of t
+//to info.
+func (t *TrudyPipe) stats(info *PipeInfo) {
+	info.Started = t.started
+	info.BytesFromClient = atomic.LoadInt64(&t.bytesFromClient)
+	info.BytesFromServer = atomic.LoadInt64(&t.bytesFromServer)
+	t.pipeMutex.Lock()
+	for key := range t.KV {
+		info.Context = append(info.Context, key)
+	}
+	t.pipeMutex.Unlock()
+	sort.Strings(info.Context)
+	info.Impairments = t.Impairments()
+}
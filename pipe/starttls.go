@@ -0,0 +1,203 @@
+package pipe
+
+import (
+	"bytes"
+	"crypto/tls"
+	"log"
+	"net"
+)
+
+//StartTLSConfig is the TLS server config presented to clients that upgrade a
+//plaintext connection with STARTTLS. If StartTLSConfig is nil, STARTTLS
+//upgrades are not intercepted and the upgraded connection is passed through
+//as ciphertext.
+var StartTLSConfig *tls.Config
+
+//startTLSProtocol describes how a protocol upgrades a plaintext connection to
+//TLS. request reports whether data sent by the client asks for the upgrade.
+//reply is called with data the server sends after a request and reports
+//whether it finishes the server's reply and, if so, whether the server
+//agreed to the upgrade.
+type startTLSProtocol struct {
+	name    string
+	request func(data []byte) bool
+	reply   func(request, data []byte) (final, accepted bool)
+}
+
+var postgresSSLRequest = []byte{0x00, 0x00, 0x00, 0x08, 0x04, 0xd2, 0x16, 0x2f}
+
+var startTLSProtocols = []startTLSProtocol{
+	{name: "SMTP",
+		request: func(data []byte) bool {
+			return bytes.EqualFold(bytes.TrimSpace(data), []byte("STARTTLS"))
+		},
+		reply: func(_, data []byte) (bool, bool) {
+			//A multiline reply has a dash after the code of every line
+			//but the last.
+			lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+			last := lines[len(lines)-1]
+			if len(last) > 3 && last[3] == '-' {
+				return false, false
+			}
+			return true, bytes.HasPrefix(last, []byte("220"))
+		}},
+	{name: "IMAP",
+		request: func(data []byte) bool {
+			fields := bytes.Fields(data)
+			return len(fields) == 2 && bytes.EqualFold(fields[1], []byte("STARTTLS"))
+		},
+		reply: func(request, data []byte) (bool, bool) {
+			//Untagged responses may come before the tagged one.
+			tag := append(append([]byte{}, bytes.Fields(request)[0]...), ' ')
+			for _, line := range bytes.Split(data, []byte("\n")) {
+				if bytes.HasPrefix(line, tag) {
+					status := bytes.Fields(line[len(tag):])
+					return true, len(status) > 0 && bytes.EqualFold(status[0], []byte("OK"))
+				}
+			}
+			return false, false
+		}},
+	{name: "POP3",
+		request: func(data []byte) bool {
+			return bytes.EqualFold(bytes.TrimSpace(data), []byte("STLS"))
+		},
+		reply: func(_, data []byte) (bool, bool) {
+			return true, bytes.HasPrefix(data, []byte("+OK"))
+		}},
+	{name: "XMPP",
+		request: func(data []byte) bool {
+			return bytes.HasPrefix(bytes.TrimSpace(data), []byte("<starttls")) &&
+				bytes.Contains(data, []byte("urn:ietf:params:xml:ns:xmpp-tls"))
+		},
+		reply: func(_, data []byte) (bool, bool) {
+			data = bytes.TrimSpace(data)
+			if bytes.HasPrefix(data, []byte("<proceed")) {
+				return true, true
+			}
+			return bytes.HasPrefix(data, []byte("<failure")), false
+		}},
+	{name: "PostgreSQL",
+		request: func(data []byte) bool {
+			return bytes.Equal(data, postgresSSLRequest)
+		},
+		reply: func(_, data []byte) (bool, bool) {
+			return true, bytes.Equal(data, []byte("S"))
+		}},
+}
+
+//startTLS is an upgrade the client has asked for but the server has not yet
+//answered. The client end of the pipe is not read until done is closed, so
+//the client's ClientHello is never mistaken for plaintext.
+type startTLS struct {
+	protocol *startTLSProtocol
+	request  []byte
+	done     chan struct{}
+}
+
+//startTLSRequest checks whether data written to the server asks for a
+//STARTTLS upgrade and, if it does, holds back the client end of the pipe
+//until the server answers.
+func (t *TrudyPipe) startTLSRequest(data []byte) {
+	if StartTLSConfig == nil {
+		return
+	}
+	if _, ok := t.ServerConn().(*net.TCPConn); !ok {
+		return
+	}
+	for i := range startTLSProtocols {
+		protocol := &startTLSProtocols[i]
+		if protocol.request(data) {
+			request := make([]byte, len(data))
+			copy(request, data)
+			t.pipeMutex.Lock()
+			t.upgrade = &startTLS{protocol: protocol, request: request, done: make(chan struct{})}
+			t.pipeMutex.Unlock()
+			return
+		}
+	}
+}
+
+//finishStartTLS releases the client end of the pipe once upgrade has been
+//answered or the pipe is closed.
+func (t *TrudyPipe) finishStartTLS(upgrade *startTLS) {
+	t.pipeMutex.Lock()
+	if t.upgrade == upgrade {
+		t.upgrade = nil
+		close(upgrade.done)
+	}
+	t.pipeMutex.Unlock()
+}
+
+//waitForStartTLS blocks until a pending STARTTLS upgrade has been answered
+//by the server.
+func (t *TrudyPipe) waitForStartTLS() {
+	t.pipeMutex.Lock()
+	upgrade := t.upgrade
+	t.pipeMutex.Unlock()
+	if upgrade != nil {
+		<-upgrade.done
+	}
+}
+
+//startTLSReply writes data from the server to the client. If data answers a
+//pending STARTTLS request and the server agreed to the upgrade, both ends of
+//the pipe are upgraded to TLS: Trudy completes a handshake with the server as
+//a client and then with the client as a server. handled is false if data
+//did not finish a pending upgrade and still needs to be written.
+func (t *TrudyPipe) startTLSReply(data []byte) (handled bool, n int, err error) {
+	t.pipeMutex.Lock()
+	upgrade := t.upgrade
+	t.pipeMutex.Unlock()
+	if upgrade == nil {
+		return
+	}
+	final, accepted := upgrade.protocol.reply(upgrade.request, data)
+	if !final {
+		return
+	}
+	defer t.finishStartTLS(upgrade)
+	if !accepted {
+		return
+	}
+
+	handled = true
+	log.Printf("[INFO] ( %v ) Upgrading %v connection with STARTTLS.\n", t.id, upgrade.protocol.name)
+	//The caller holds clientWriteMutex. Nothing else may be written to
+	//the server either until both ends are upgraded, or it would land in
+	//the middle of a handshake. Both ends must also have been sent
+	//everything written before the upgrade.
+	t.serverWriteMutex.Lock()
+	defer t.serverWriteMutex.Unlock()
+	t.flush(t.clientLine)
+	t.flush(t.serverLine)
+	plainClient, plainServer := t.ClientConn(), t.ServerConn()
+	n, err = plainClient.Write(data)
+	if err != nil {
+		return
+	}
+
+	until := deadline(t.timeouts.Handshake)
+	serverConfig := serverTLSConfig(t.destination, plainClient.RemoteAddr())
+	if host, _, _ := net.SplitHostPort(t.destination); serverConfig.ServerName == "" && net.ParseIP(host) == nil {
+		serverConfig.ServerName = host
+	}
+	serverConn := tls.Client(plainServer, serverConfig)
+	serverConn.SetDeadline(until)
+	if err = serverConn.Handshake(); err != nil {
+		log.Printf("[ERR] ( %v ) STARTTLS handshake with the server failed: %v\n", t.id, err)
+		return
+	}
+	//The server end has already been upgraded, so there is nothing to
+	//mirror.
+	clientConfig := StartTLSConfig.Clone()
+	clientConfig.GetConfigForClient = nil
+	clientConn := tls.Server(plainClient, clientConfig)
+	clientConn.SetDeadline(until)
+	if err = clientConn.Handshake(); err != nil {
+		log.Printf("[ERR] ( %v ) STARTTLS handshake with the client failed: %v\n", t.id, err)
+		return
+	}
+	t.SetServerConn(serverConn)
+	t.SetClientConn(clientConn)
+	return
+}
@@ -0,0 +1,84 @@
+package pipe
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+//TestStartTLSInjection injects data toward the server while an SMTP STARTTLS
+//upgrade is in progress. The data must reach the server over TLS, after the
+//handshake. Run it with -race.
+func TestStartTLSInjection(t *testing.T) {
+	cert := selfSigned(t)
+	StartTLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	defer func() { StartTLSConfig = nil }()
+
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	const injections = 5
+	injected := []byte("NOOP\r\n")
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		request := make([]byte, len("STARTTLS\r\n"))
+		io.ReadFull(conn, request)
+		upgraded := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+		data := make([]byte, injections*len(injected))
+		n, _ := io.ReadFull(upgraded, data)
+		received <- data[:n]
+	}()
+	serverEnd, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientEnd, trudyEnd := net.Pipe()
+	defer clientEnd.Close()
+	p := new(TrudyPipe)
+	p.prepare(0, trudyEnd)
+	p.init(0, "mail.example.com:25", trudyEnd, serverEnd, DefaultTimeouts)
+	defer p.Close()
+
+	upgrading := make(chan struct{})
+	go func() {
+		reply := make([]byte, len("220 Go ahead\r\n"))
+		io.ReadFull(clientEnd, reply)
+		close(upgrading)
+		client := tls.Client(clientEnd, &tls.Config{InsecureSkipVerify: true})
+		io.Copy(io.Discard, client)
+	}()
+
+	if _, err = p.WriteToServer([]byte("STARTTLS\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	go p.WriteToClient([]byte("220 Go ahead\r\n"))
+	<-upgrading
+	for i := 0; i < injections; i++ {
+		if _, err = p.WriteToServer(injected); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case data := <-received:
+		if want := bytes.Repeat(injected, injections); !bytes.Equal(data, want) {
+			t.Errorf("the server got %q, want %q", data, want)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the server got nothing")
+	}
+	if _, ok := p.ServerConn().(*tls.Conn); !ok {
+		t.Error("the server end wasn't upgraded")
+	}
+}
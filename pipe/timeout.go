@@ -0,0 +1,162 @@
+package pipe
+
+import (
+	"encoding/json"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+//Timeouts holds the timeouts of a pipe. A zero timeout means no timeout.
+type Timeouts struct {
+	//Idle closes the pipe once neither end has sent anything for this long.
+	Idle time.Duration
+	//Read closes the pipe once one end has sent nothing for this long, even
+	//if the other end is still active.
+	Read time.Duration
+	//Write closes the pipe if a write to either end blocks for this long.
+	Write time.Duration
+	//Dial limits how long connecting to the server may take.
+	Dial time.Duration
+	//Handshake limits how long a TLS handshake with either end may take.
+	Handshake time.Duration
+	//KeepAlive is the TCP keepalive period of both ends. Zero disables
+	//keepalives.
+	KeepAlive time.Duration
+}
+
+//DefaultTimeouts are the timeouts of TCP pipes to destinations without
+//TimeoutsConfig settings of their own.
+var DefaultTimeouts = Timeouts{Read: 15 * time.Second, Write: 15 * time.Second, Handshake: 15 * time.Second,
+	KeepAlive: 15 * time.Second}
+
+//TimeoutsConfig overrides the default timeouts for a destination. Timeouts
+//that are not set keep their default.
+type TimeoutsConfig struct {
+	Idle      *Duration `json:"idle"`
+	Read      *Duration `json:"read"`
+	Write     *Duration `json:"write"`
+	Dial      *Duration `json:"dial"`
+	Handshake *Duration `json:"handshake"`
+	KeepAlive *Duration `json:"keepalive"`
+}
+
+//Duration is a time.Duration written as a string like "90s" or "5m" in JSON.
+//"0" means no timeout.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	*d = Duration(v)
+	return err
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+//timeoutsFor returns the timeouts for the pipe to addr, starting from
+//defaults and applying the destination's TimeoutsConfig, if any.
+func timeoutsFor(addr string, defaults Timeouts) Timeouts {
+	timeouts := defaults
+	dest := destinationConfig(addr)
+	if dest == nil || dest.Timeouts == nil {
+		return timeouts
+	}
+	override := func(timeout *time.Duration, d *Duration) {
+		if d != nil {
+			*timeout = time.Duration(*d)
+		}
+	}
+	override(&timeouts.Idle, dest.Timeouts.Idle)
+	override(&timeouts.Read, dest.Timeouts.Read)
+	override(&timeouts.Write, dest.Timeouts.Write)
+	override(&timeouts.Dial, dest.Timeouts.Dial)
+	override(&timeouts.Handshake, dest.Timeouts.Handshake)
+	override(&timeouts.KeepAlive, dest.Timeouts.KeepAlive)
+	return timeouts
+}
+
+//deadline returns the deadline for an operation that may take timeout, or
+//the zero time (no deadline) if timeout is zero.
+func deadline(timeout time.Duration) time.Time {
+	if timeout == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+//setKeepAlive applies the keepalive period to the TCP connection beneath conn,
+//if there is one.
+func setKeepAlive(conn net.Conn, period time.Duration) {
+	for c := conn; c != nil; c = unwrap(c) {
+		if tcpConn, ok := c.(*net.TCPConn); ok {
+			tcpConn.SetKeepAlive(period > 0)
+			if period > 0 {
+				tcpConn.SetKeepAlivePeriod(period)
+			}
+			return
+		}
+	}
+}
+
+func (t *TrudyPipe) touch() {
+	atomic.StoreInt64(&t.lastActive, time.Now().UnixNano())
+}
+
+func (t *TrudyPipe) idleSince() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&t.lastActive))
+}
+
+//watchIdle closes the pipe once it has been idle for the idle timeout.
+func (t *TrudyPipe) watchIdle() {
+	t.touch()
+	if t.timeouts.Idle == 0 {
+		return
+	}
+	var check func()
+	check = func() {
+		idle := time.Since(t.idleSince())
+		if idle >= t.timeouts.Idle {
+			t.Close()
+			return
+		}
+		t.pipeMutex.Lock()
+		if t.idleTimer != nil {
+			t.idleTimer = time.AfterFunc(t.timeouts.Idle-idle, check)
+		}
+		t.pipeMutex.Unlock()
+	}
+	t.pipeMutex.Lock()
+	t.idleTimer = time.AfterFunc(t.timeouts.Idle, check)
+	t.pipeMutex.Unlock()
+}
+
+//read reads from conn, which is one end of the pipe, within the read timeout
+//and adds the number of bytes read to count.
+func (t *TrudyPipe) read(conn net.Conn, buffer []byte, count *int64) (n int, err error) {
+	err = conn.SetReadDeadline(deadline(t.timeouts.Read))
+	if err != nil {
+		return
+	}
+	n, err = conn.Read(buffer)
+	if n > 0 {
+		t.touch()
+		atomic.AddInt64(count, int64(n))
+	}
+	return
+}
+
+//write writes to conn, which is one end of the pipe, within the write
+//timeout.
+func (t *TrudyPipe) write(conn net.Conn, buffer []byte) (n int, err error) {
+	err = conn.SetWriteDeadline(deadline(t.timeouts.Write))
+	if err != nil {
+		return
+	}
+	return conn.Write(buffer)
+}
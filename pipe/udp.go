@@ -0,0 +1,53 @@
+package pipe
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+//UDPFlowTimeout is how long a UDP flow may go without a datagram in either
+//direction before its UDPPipe is closed.
+var UDPFlowTimeout = 60 * time.Second
+
+//UDPPipe implements the Pipe interface and can be used to proxy UDP flows.
+//Every read and write on a UDPPipe handles a single datagram. Unlike a
+//TrudyPipe, a UDPPipe has no read timeout by default and is only closed once
+//the flow has been idle in both directions for UDPFlowTimeout. The flow's
+//timeouts can be changed per destination like a TrudyPipe's.
+type UDPPipe struct {
+	TrudyPipe
+}
+
+//New builds a new UDPPipe. The client connection must either implement
+//Destination or report the client's original destination as its local
+//address, like a TPROXY socket. New will then open a UDP socket to that
+//original destination. The fd and useTLS parameters are ignored.
+func (u *UDPPipe) New(id uint, fd int, clientConn net.Conn, useTLS bool) (err error) {
+	u.prepare(id, clientConn)
+	var originalAddr string
+	if dest, ok := clientConn.(Destination); ok {
+		originalAddr = dest.Destination()
+	} else if local, ok := clientConn.LocalAddr().(*net.UDPAddr); ok {
+		originalAddr = local.String()
+	} else {
+		clientConn.Close()
+		return net.InvalidAddrError("UDPPipe requires a UDP client connection")
+	}
+	u.destination = originalAddr
+	if originalAddr, err = beforeDial(id, clientConn, originalAddr); err != nil {
+		clientConn.Close()
+		return err
+	}
+	u.destination = originalAddr
+	timeouts := timeoutsFor(originalAddr, Timeouts{Idle: UDPFlowTimeout, Write: DefaultTimeouts.Write})
+	dialer := &net.Dialer{Timeout: timeouts.Dial}
+	serverConn, err := dialer.Dial("udp", originalAddr)
+	if err != nil {
+		log.Printf("[ERR] ( %v ) Unable to connect to destination. Closing pipe.\n", id)
+		clientConn.Close()
+		return err
+	}
+	u.init(id, originalAddr, clientConn, serverConn, timeouts)
+	return nil
+}